@@ -0,0 +1,170 @@
+package chwriter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the circuit breaker options other than circuit_failures, which
+// enables the breaker.
+const (
+	defaultCircuitSuccesses     = 1
+	defaultCircuitProbeInterval = 30 * time.Second
+)
+
+// Values of the circuit_open_action option.
+const (
+	circuitActionDrop  = "drop"
+	circuitActionError = "error"
+)
+
+// errCircuitOpen is returned by Write while the circuit is open and
+// circuit_open_action is error.
+var errCircuitOpen = errors.New("clickhouse writer circuit is open, ClickHouse is unavailable")
+
+// circuitState is the state of a circuitBreaker.
+type circuitState int
+
+const (
+	// circuitClosed is normal operation: rows are buffered and flushed.
+	circuitClosed circuitState = iota
+	// circuitOpen follows failureThreshold consecutive failed flushes. Rows
+	// are rejected by Write and nothing is flushed until probeInterval has
+	// passed.
+	circuitOpen
+	// circuitHalfOpen is entered once a probe of an open circuit succeeds.
+	// Rows are still rejected while probes continue every flush interval,
+	// until successThreshold of them have succeeded in a row and the
+	// circuit closes, or one fails and it opens again.
+	circuitHalfOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops a writer from buffering and retrying during a
+// sustained outage. It is guarded by the connection's bufferMu; a zero
+// failureThreshold disables it.
+type circuitBreaker struct {
+	failureThreshold int
+	successThreshold int
+	probeInterval    time.Duration
+	dropRows         bool
+
+	state     circuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+
+	// opens counts how often the circuit opened, rejected counts the rows
+	// Write rejected or dropped while it was not closed.
+	opens    uint64
+	rejected uint64
+}
+
+// accepting reports whether Write may buffer rows.
+func (cb *circuitBreaker) accepting() bool {
+	return cb.failureThreshold == 0 || cb.state == circuitClosed
+}
+
+// probeDue reports whether the circuit is not closed and a probe should be
+// made now.
+func (cb *circuitBreaker) probeDue(now time.Time) bool {
+	switch cb.state {
+	case circuitOpen:
+		return now.Sub(cb.openedAt) >= cb.probeInterval
+	case circuitHalfOpen:
+		return true
+	default:
+		return false
+	}
+}
+
+// record updates the circuit with the outcome of a flush or probe and
+// returns the previous state.
+func (cb *circuitBreaker) record(err error, now time.Time) circuitState {
+	prev := cb.state
+	if err != nil {
+		cb.successes = 0
+		if cb.failures++; cb.state != circuitClosed || cb.failures >= cb.failureThreshold {
+			if cb.state == circuitClosed {
+				cb.opens++
+			}
+			cb.state = circuitOpen
+			cb.openedAt = now
+		}
+		return prev
+	}
+
+	cb.failures = 0
+	if cb.state != circuitClosed {
+		cb.state = circuitHalfOpen
+		if cb.successes++; cb.successes >= cb.successThreshold {
+			cb.state = circuitClosed
+			cb.successes = 0
+		}
+	}
+	return prev
+}
+
+// circuitAllowsFlush reports whether the flush loop should flush. While the
+// circuit is not closed it only pings the server once a probe is due, and
+// flushing resumes once the circuit has closed.
+func (conn *clickhouseConn) circuitAllowsFlush() bool {
+	conn.bufferMu.Lock()
+	cb := &conn.circuit
+	if cb.failureThreshold == 0 || cb.state == circuitClosed {
+		conn.bufferMu.Unlock()
+		return true
+	}
+	due := cb.probeDue(time.Now())
+	conn.bufferMu.Unlock()
+	if !due {
+		return false
+	}
+
+	conn.connMu.RLock()
+	err := conn.Conn.Ping(conn.queryContext(context.Background()))
+	conn.connMu.RUnlock()
+	conn.recordCircuit(err)
+
+	conn.bufferMu.Lock()
+	defer conn.bufferMu.Unlock()
+	return cb.state == circuitClosed
+}
+
+// recordCircuit feeds the outcome of a flush or probe to the circuit breaker
+// and logs state changes.
+func (conn *clickhouseConn) recordCircuit(err error) {
+	conn.bufferMu.Lock()
+	cb := &conn.circuit
+	if cb.failureThreshold == 0 {
+		conn.bufferMu.Unlock()
+		return
+	}
+	prev := cb.record(err, time.Now())
+	state := cb.state
+	conn.bufferMu.Unlock()
+
+	switch {
+	case state == prev:
+	case state == circuitOpen:
+		conn.logger.Error("opening circuit, rejecting rows until ClickHouse recovers",
+			zap.String("writer", conn.key), zap.Duration("probe_interval", cb.probeInterval), zap.Error(err))
+	case state == circuitClosed:
+		conn.logger.Info("closing circuit, ClickHouse recovered", zap.String("writer", conn.key))
+	default:
+		conn.logger.Info("circuit half-open, probing ClickHouse", zap.String("writer", conn.key))
+	}
+}
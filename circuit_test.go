@@ -0,0 +1,128 @@
+package chwriter
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitTransitions(t *testing.T) {
+	errDown := errors.New("server unavailable")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cb := circuitBreaker{failureThreshold: 3, successThreshold: 2, probeInterval: time.Minute}
+
+	step := func(name string, err error, now time.Time, want circuitState) {
+		t.Helper()
+		cb.record(err, now)
+		if cb.state != want {
+			t.Fatalf("%s: state = %v, want %v", name, cb.state, want)
+		}
+	}
+
+	step("first failure", errDown, start, circuitClosed)
+	step("second failure", errDown, start, circuitClosed)
+	step("success resets the failures", nil, start, circuitClosed)
+	step("failure after success", errDown, start, circuitClosed)
+	step("second failure", errDown, start, circuitClosed)
+	step("threshold reached", errDown, start, circuitOpen)
+	if cb.opens != 1 || cb.accepting() {
+		t.Fatalf("open circuit: opens = %d, accepting = %v, want 1 and false", cb.opens, cb.accepting())
+	}
+
+	if cb.probeDue(start.Add(time.Minute - time.Second)) {
+		t.Error("probe due before probe_interval has passed")
+	}
+	if !cb.probeDue(start.Add(time.Minute)) {
+		t.Error("probe not due once probe_interval has passed")
+	}
+	probe := start.Add(time.Minute)
+	step("failed probe", errDown, probe, circuitOpen)
+	if cb.probeDue(probe.Add(time.Second)) {
+		t.Error("failed probe did not restart probe_interval")
+	}
+
+	probe = probe.Add(time.Minute)
+	step("successful probe", nil, probe, circuitHalfOpen)
+	if !cb.probeDue(probe) || cb.accepting() {
+		t.Error("half-open circuit must probe every flush interval and keep rejecting rows")
+	}
+	step("failed half-open probe", errDown, probe, circuitOpen)
+	if cb.opens != 1 {
+		t.Errorf("opens = %d after reopening from half-open, want 1", cb.opens)
+	}
+
+	probe = probe.Add(time.Minute)
+	step("successful probe", nil, probe, circuitHalfOpen)
+	step("second successful probe", nil, probe, circuitClosed)
+	if !cb.accepting() || cb.probeDue(probe) {
+		t.Error("closed circuit must accept rows without probing")
+	}
+	step("single failure after closing", errDown, probe, circuitClosed)
+}
+
+func TestCircuitSingleSuccessCloses(t *testing.T) {
+	cb := circuitBreaker{failureThreshold: 1, successThreshold: 1, probeInterval: time.Minute}
+	now := time.Now()
+	cb.record(errors.New("down"), now)
+	if cb.state != circuitOpen {
+		t.Fatalf("state = %v, want open", cb.state)
+	}
+	cb.record(nil, now.Add(time.Minute))
+	if cb.state != circuitClosed {
+		t.Errorf("state = %v, want closed after one success", cb.state)
+	}
+}
+
+func TestCircuitDisabled(t *testing.T) {
+	var cb circuitBreaker
+	for range 10 {
+		cb.record(errors.New("down"), time.Now())
+	}
+	if !cb.accepting() {
+		t.Error("circuit without circuit_failures rejects rows")
+	}
+}
+
+func TestWriteWhileCircuitOpen(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		fake := newFakeConn("uri String")
+		conn := newTestConn(fake)
+		conn.circuit = circuitBreaker{failureThreshold: 1, successThreshold: 1, probeInterval: time.Hour, dropRows: drop}
+		conn.recordCircuit(errors.New("down"))
+
+		n, err := conn.Write([]byte(`{"uri":"/"}`))
+		if drop && (err != nil || n == 0) {
+			t.Errorf("drop: Write = %d, %v, want the line dropped silently", n, err)
+		}
+		if !drop && !errors.Is(err, errCircuitOpen) {
+			t.Errorf("error: Write = %d, %v, want errCircuitOpen", n, err)
+		}
+		if len(conn.buffer) != 0 || conn.circuit.rejected != 1 {
+			t.Errorf("drop %v: %d rows buffered and %d rejected, want 0 and 1", drop, len(conn.buffer), conn.circuit.rejected)
+		}
+	}
+}
+
+// The flush loop pings the server once a probe is due and resumes flushing
+// when the circuit closes.
+func TestCircuitAllowsFlush(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := newTestConn(fake)
+	conn.circuit = circuitBreaker{failureThreshold: 1, successThreshold: 1}
+	if !conn.circuitAllowsFlush() {
+		t.Fatal("closed circuit does not allow flushing")
+	}
+
+	conn.recordCircuit(errors.New("down"))
+	fake.pingErr = errors.New("still down")
+	if conn.circuitAllowsFlush() {
+		t.Error("flush allowed after a failed probe")
+	}
+	fake.pingErr = nil
+	if !conn.circuitAllowsFlush() {
+		t.Error("flush not allowed after a successful probe")
+	}
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Errorf("Write after the circuit closed: %v", err)
+	}
+}
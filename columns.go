@@ -0,0 +1,351 @@
+package chwriter
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The fields request_size_column and response_size_column read by default,
+// in order of preference. Caddy logs the sizes at the top level as bytes_read
+// and size, but some versions and log encoders nest them under request or
+// name the response size bytes_written.
+var (
+	defaultRequestSizeFields  = []string{"bytes_read", "request.bytes_read"}
+	defaultResponseSizeFields = []string{"size", "bytes_written", "request.bytes_written"}
+)
+
+// defaultServerNameField is the field server_name_column reads by default:
+// the host the request was addressed to, which identifies the site.
+const defaultServerNameField = "request.host"
+
+// userIDField is the field of Caddy's access log that holds the user
+// authenticated by the request's handlers. It is empty for anonymous
+// requests.
+var userIDField = mustParsePath("user_id")
+
+// Fields of Caddy's access log that hold the negotiated TLS version and
+// cipher suite as numeric IDs. They are absent for plaintext requests.
+var (
+	tlsVersionField = mustParsePath("request.tls.version")
+	tlsCipherField  = mustParsePath("request.tls.cipher_suite")
+)
+
+// durationField is the field of Caddy's access log that holds how long the
+// request took, in seconds with the default duration_format.
+var durationField = mustParsePath("duration")
+
+// Values of the duration_non_finite option.
+const (
+	nonFiniteZero = "zero"
+	nonFiniteNull = "null"
+)
+
+// Fields of Caddy's access log that hold the client address: client_ip is
+// the client as determined with trusted_proxies, remote_ip the peer of the
+// connection, which older versions log alone.
+var (
+	clientIPField = mustParsePath("request.client_ip")
+	remoteIPField = mustParsePath("request.remote_ip")
+)
+
+// cacheStatusField is the field of Caddy's access log that holds the
+// Cache-Status response header of RFC 9211, which caching handlers such as
+// cache-handler set, e.g. "Souin; hit; ttl=120" or "Souin; fwd=uri-miss".
+var cacheStatusField = mustParsePath("resp_headers.Cache-Status[0]")
+
+// Values of the cache_status_type option, and the values an enum cache
+// status column receives.
+const (
+	cacheStatusEnum    = "enum"
+	cacheStatusBool    = "bool"
+	cacheStatusHit     = "hit"
+	cacheStatusMiss    = "miss"
+	cacheStatusUnknown = "unknown"
+)
+
+// columnMapping derives additional columns from the decoded log line just
+// before it is appended to a batch, and coerces fields the driver could not
+// insert as decoded. An empty column name disables the corresponding mapping.
+type columnMapping struct {
+	requestSize     sizeColumn
+	responseSize    sizeColumn
+	timestampField  string
+	timestampPath   fieldPath
+	timestampLayout string
+	date            string
+	location        *time.Location
+	receivedAt      string
+	tlsVersion      string
+	tlsCipher       string
+	ipFamily        string
+	path            string
+	query           string
+	durationSeconds string
+	durationNull    bool
+	cacheStatus     string
+	cacheStatusBool bool
+	jsonStrings     map[string]fieldPath
+	constants       map[string]string
+	defaults        map[string]any
+	caseInsensitive bool
+	serverName      stringColumn
+	handler         stringColumn
+	user            stringColumn
+}
+
+// stringColumn copies a string field of the log line into a column, storing
+// fallback when the field is missing or empty.
+type stringColumn struct {
+	column   string
+	field    fieldPath
+	fallback string
+}
+
+// apply sets the column of row if it is configured.
+func (sc *stringColumn) apply(row map[string]any) {
+	if sc.column == "" {
+		return
+	}
+	value, _ := sc.field.lookup(row).(string)
+	if value == "" {
+		value = sc.fallback
+	}
+	row[sc.column] = value
+}
+
+// sizeColumn stores a byte count in an integer column, read from the first of
+// fields that is present in the log line.
+type sizeColumn struct {
+	column string
+	fields []fieldPath
+}
+
+// apply sets the column of row if it is configured. It is zero when none of
+// the fields is present.
+func (sc *sizeColumn) apply(row map[string]any) {
+	if sc.column == "" {
+		return
+	}
+	var value any
+	for _, field := range sc.fields {
+		if value = field.lookup(row); value != nil {
+			break
+		}
+	}
+	row[sc.column] = toUint64(value)
+}
+
+// apply returns the fields of a buffered row along with its derived
+// columns. The derived columns are set on a copy, so that the buffered
+// fields stay as they were logged: a row is mapped again when a failed
+// flush is retried, when it is sent to the dual_write server and, with
+// missing_columns strict, when it is grouped, and a derived column named
+// after the field it is derived from, such as a size column named "size",
+// must not be derived from its own output.
+func (mapping *columnMapping) apply(buffered bufferedRow) map[string]any {
+	row := maps.Clone(buffered.fields)
+	if mapping.receivedAt != "" {
+		row[mapping.receivedAt] = buffered.receivedAt
+	}
+	if mapping.timestampField != "" {
+		mapping.coerceTimestamp(row)
+	}
+	if mapping.date != "" {
+		ts, ok := parseTimestamp(mapping.timestampPath.lookup(row), mapping.timestampLayout)
+		if !ok {
+			ts = buffered.receivedAt
+		}
+		row[mapping.date] = calendarDate(ts, mapping.location)
+	}
+	mapping.requestSize.apply(row)
+	mapping.responseSize.apply(row)
+	if mapping.tlsVersion != "" {
+		row[mapping.tlsVersion] = tlsName(tlsVersionField.lookup(row), tls.VersionName)
+	}
+	if mapping.tlsCipher != "" {
+		row[mapping.tlsCipher] = tlsName(tlsCipherField.lookup(row), tls.CipherSuiteName)
+	}
+	if mapping.durationSeconds != "" {
+		row[mapping.durationSeconds] = mapping.durationValue(durationField.lookup(row))
+	}
+	if mapping.ipFamily != "" {
+		row[mapping.ipFamily] = ipFamily(row)
+	}
+	if mapping.cacheStatus != "" {
+		status := cacheStatus(cacheStatusField.lookup(row))
+		if mapping.cacheStatusBool {
+			row[mapping.cacheStatus] = status == cacheStatusHit
+		} else {
+			row[mapping.cacheStatus] = status
+		}
+	}
+	if mapping.path != "" || mapping.query != "" {
+		mapping.splitURI(row)
+	}
+	for column, field := range mapping.jsonStrings {
+		if value := field.lookup(row); value != nil {
+			row[column] = jsonString(value)
+		}
+	}
+	for column, value := range mapping.constants {
+		row[column] = value
+	}
+	mapping.serverName.apply(row)
+	mapping.handler.apply(row)
+	mapping.user.apply(row)
+	for column, value := range mapping.defaults {
+		if !hasField(row, column, mapping.caseInsensitive) {
+			row[column] = value
+		}
+	}
+	return row
+}
+
+// tlsName converts a numeric TLS version or cipher suite ID to its name, such
+// as "TLS 1.3" or "TLS_AES_128_GCM_SHA256". Names that Caddy already logged
+// as strings are kept, and a missing value becomes the empty string.
+func tlsName(value any, name func(uint16) string) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case nil:
+		return ""
+	}
+	id := toUint64(value)
+	if id == 0 || id > math.MaxUint16 {
+		return ""
+	}
+	return name(uint16(id))
+}
+
+// ipFamily returns "v4" or "v6" for the client address of row, or "unknown"
+// if it is missing or cannot be parsed. IPv4-mapped IPv6 addresses, as seen
+// on dual-stack listeners, count as v4.
+func ipFamily(row map[string]any) string {
+	ip, _ := clientIPField.lookup(row).(string)
+	if ip == "" {
+		ip, _ = remoteIPField.lookup(row).(string)
+	}
+	addr, err := netip.ParseAddr(ip)
+	switch {
+	case err != nil:
+		return "unknown"
+	case addr.Unmap().Is4():
+		return "v4"
+	default:
+		return "v6"
+	}
+}
+
+// cacheStatus classifies a Cache-Status header as a hit, a miss or unknown
+// if it is missing. When several caches are listed, the last one, which is
+// the closest to the client, decides. Its "hit" parameter makes a hit and
+// a "fwd" parameter, which says why the request was forwarded, a miss.
+// Caches that only send HIT or MISS, like an X-Cache header, are understood
+// too.
+func cacheStatus(value any) string {
+	header, _ := value.(string)
+	entries := strings.Split(header, ",")
+	params := strings.Split(entries[len(entries)-1], ";")
+	for _, param := range params[1:] {
+		name, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(name) {
+		case "hit":
+			return cacheStatusHit
+		case "fwd":
+			return cacheStatusMiss
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(params[0])) {
+	case "hit":
+		return cacheStatusHit
+	case "miss":
+		return cacheStatusMiss
+	}
+	return cacheStatusUnknown
+}
+
+// durationValue converts a logged duration to seconds. Numbers are taken to
+// be seconds and strings are parsed as a Go duration such as "1.5ms" or as a
+// number of seconds. Missing or unparseable durations are zero. NaN and
+// infinite values, which only a string can carry, are zero or, with
+// duration_non_finite null, nil.
+func (mapping *columnMapping) durationValue(value any) any {
+	var seconds float64
+	switch value := value.(type) {
+	case float64:
+		seconds = value
+	case string:
+		if d, err := time.ParseDuration(value); err == nil {
+			seconds = d.Seconds()
+		} else if n, err := strconv.ParseFloat(value, 64); err == nil {
+			seconds = n
+		}
+	}
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		if mapping.durationNull {
+			return nil
+		}
+		return float64(0)
+	}
+	return seconds
+}
+
+// splitURI stores the path and the raw query string of the request URI in
+// the path and query columns. The path keeps its percent-encoding, as it was
+// requested. A URI that cannot be parsed is stored in the path column as is,
+// with an empty query.
+func (mapping *columnMapping) splitURI(row map[string]any) {
+	uri, _ := requestURIField.lookup(row).(string)
+	path, query := uri, ""
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		path, query = u.EscapedPath(), u.RawQuery
+	}
+	if mapping.path != "" {
+		row[mapping.path] = path
+	}
+	if mapping.query != "" {
+		row[mapping.query] = query
+	}
+}
+
+// jsonString encodes a decoded object or array as JSON so that it can be
+// stored in a String column. Other values, such as strings, are returned as
+// is.
+func jsonString(value any) any {
+	switch value.(type) {
+	case map[string]any, []any:
+		// Values decoded from JSON always encode again.
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	default:
+		return value
+	}
+}
+
+// toUint64 coerces a decoded JSON number or numeric string to an unsigned
+// integer. Missing, negative and unparseable values become zero.
+func toUint64(value any) uint64 {
+	switch value := value.(type) {
+	case float64:
+		if value < 0 || math.IsNaN(value) || value > math.MaxUint64 {
+			return 0
+		}
+		return uint64(value)
+	case string:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n
+	default:
+		return 0
+	}
+}
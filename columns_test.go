@@ -0,0 +1,348 @@
+package chwriter
+
+import (
+	"maps"
+	"testing"
+	"time"
+)
+
+// testPaths parses field paths that are known to be valid.
+func testPaths(paths []string) []fieldPath {
+	parsed, err := parsePaths(paths)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestSizeColumn(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]any
+		want   uint64
+	}{
+		{"present", map[string]any{"size": float64(512)}, 512},
+		{"zero", map[string]any{"size": float64(0)}, 0},
+		{"missing", map[string]any{}, 0},
+		{"string", map[string]any{"size": "2048"}, 2048},
+		{"negative", map[string]any{"size": float64(-1)}, 0},
+		{"fallback", map[string]any{"bytes_written": float64(64)}, 64},
+		{"nested fallback", map[string]any{"request": map[string]any{"bytes_written": float64(32)}}, 32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := sizeColumn{column: "response_size", fields: testPaths(defaultResponseSizeFields)}
+			sc.apply(tt.fields)
+			if got := tt.fields["response_size"]; got != tt.want {
+				t.Errorf("response_size = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A size column named after the field it is read from must keep its value
+// when the row is mapped again, as it is on retries and with dual_write.
+func TestApplyDoesNotModifyRow(t *testing.T) {
+	mapping := &columnMapping{
+		requestSize:  sizeColumn{column: "bytes_read", fields: testPaths(defaultRequestSizeFields)},
+		responseSize: sizeColumn{column: "size", fields: testPaths(defaultResponseSizeFields)},
+		receivedAt:   "received_at",
+	}
+	row := bufferedRow{
+		fields:     map[string]any{"bytes_read": float64(100), "size": float64(200)},
+		receivedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	logged := maps.Clone(row.fields)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		fields := mapping.apply(row)
+		if fields["bytes_read"] != uint64(100) || fields["size"] != uint64(200) {
+			t.Fatalf("attempt %d: bytes_read = %v, size = %v, want 100 and 200",
+				attempt, fields["bytes_read"], fields["size"])
+		}
+		if fields["received_at"] != row.receivedAt {
+			t.Fatalf("attempt %d: received_at = %v, want %v", attempt, fields["received_at"], row.receivedAt)
+		}
+	}
+	if !maps.Equal(row.fields, logged) {
+		t.Errorf("buffered fields = %v, want them unchanged as %v", row.fields, logged)
+	}
+}
+
+// applyTest maps fields with mapping and returns the result.
+func applyTest(mapping columnMapping, fields map[string]any) map[string]any {
+	return mapping.apply(bufferedRow{fields: fields, receivedAt: time.Now()})
+}
+
+func TestServerNameColumn(t *testing.T) {
+	mapping := columnMapping{serverName: stringColumn{
+		column:   "server_name",
+		field:    mustParsePath(defaultServerNameField),
+		fallback: "default-site",
+	}}
+	tests := []struct {
+		name   string
+		fields map[string]any
+		want   string
+	}{
+		{"present", map[string]any{"request": map[string]any{"host": "example.com"}}, "example.com"},
+		{"empty", map[string]any{"request": map[string]any{"host": ""}}, "default-site"},
+		{"absent", map[string]any{"request": map[string]any{}}, "default-site"},
+		{"not a string", map[string]any{"request": map[string]any{"host": 1.0}}, "default-site"},
+	}
+	for _, tt := range tests {
+		if got := applyTest(mapping, tt.fields)["server_name"]; got != tt.want {
+			t.Errorf("%s: server_name = %v, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, ok := applyTest(columnMapping{}, map[string]any{})["server_name"]; ok {
+		t.Error("server_name set without server_name_column")
+	}
+}
+
+func TestHandlerColumn(t *testing.T) {
+	mapping := columnMapping{handler: stringColumn{
+		column:   "handler",
+		field:    mustParsePath("route[0]"),
+		fallback: "unrouted",
+	}}
+	if got := applyTest(mapping, map[string]any{"route": []any{"api", "v2"}})["handler"]; got != "api" {
+		t.Errorf("present: handler = %v, want api", got)
+	}
+	if got := applyTest(mapping, map[string]any{})["handler"]; got != "unrouted" {
+		t.Errorf("absent: handler = %v, want unrouted", got)
+	}
+	if _, ok := applyTest(columnMapping{}, map[string]any{"route": []any{"api"}})["handler"]; ok {
+		t.Error("handler set without handler_column")
+	}
+}
+
+// The first candidate field that is present wins, even if it is zero, and
+// candidates are tried in the configured order.
+func TestSizeColumnCandidates(t *testing.T) {
+	sc := sizeColumn{column: "bytes", fields: testPaths([]string{"upstream.bytes", "size"})}
+	tests := []struct {
+		name   string
+		fields map[string]any
+		want   uint64
+	}{
+		{"first", map[string]any{"upstream": map[string]any{"bytes": 7.0}, "size": 9.0}, 7},
+		{"first is zero", map[string]any{"upstream": map[string]any{"bytes": 0.0}, "size": 9.0}, 0},
+		{"second", map[string]any{"size": 9.0}, 9},
+		{"none", map[string]any{"bytes_read": 5.0}, 0},
+	}
+	for _, tt := range tests {
+		sc.apply(tt.fields)
+		if got := tt.fields["bytes"]; got != tt.want {
+			t.Errorf("%s: bytes = %v, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTLSColumns(t *testing.T) {
+	mapping := columnMapping{tlsVersion: "tls_version", tlsCipher: "tls_cipher"}
+	tests := []struct {
+		name        string
+		tls         any
+		version     string
+		cipherSuite string
+	}{
+		{"numeric", map[string]any{"version": 772.0, "cipher_suite": 4865.0}, "TLS 1.3", "TLS_AES_128_GCM_SHA256"},
+		{"named", map[string]any{"version": "TLS 1.2", "cipher_suite": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			"TLS 1.2", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		{"plaintext", nil, "", ""},
+		{"out of range", map[string]any{"version": 70000.0, "cipher_suite": 0.0}, "", ""},
+	}
+	for _, tt := range tests {
+		request := map[string]any{}
+		if tt.tls != nil {
+			request["tls"] = tt.tls
+		}
+		row := applyTest(mapping, map[string]any{"request": request})
+		if row["tls_version"] != tt.version || row["tls_cipher"] != tt.cipherSuite {
+			t.Errorf("%s: tls_version = %q, tls_cipher = %q, want %q and %q",
+				tt.name, row["tls_version"], row["tls_cipher"], tt.version, tt.cipherSuite)
+		}
+	}
+
+	row := applyTest(columnMapping{}, map[string]any{"request": map[string]any{"tls": map[string]any{"version": 772.0}}})
+	if _, ok := row["tls_version"]; ok {
+		t.Error("tls_version set without tls_version_column")
+	}
+}
+
+func TestUserColumn(t *testing.T) {
+	mapping := columnMapping{user: stringColumn{column: "user", field: userIDField, fallback: "anonymous"}}
+	if got := applyTest(mapping, map[string]any{"user_id": "alice"})["user"]; got != "alice" {
+		t.Errorf("authenticated: user = %v, want alice", got)
+	}
+	// Caddy logs an empty user_id for anonymous requests.
+	if got := applyTest(mapping, map[string]any{"user_id": ""})["user"]; got != "anonymous" {
+		t.Errorf("anonymous: user = %v, want anonymous", got)
+	}
+	if got := applyTest(mapping, map[string]any{})["user"]; got != "anonymous" {
+		t.Errorf("absent: user = %v, want anonymous", got)
+	}
+	if _, ok := applyTest(columnMapping{}, map[string]any{"user_id": "alice"})["user"]; ok {
+		t.Error("user set without user_column")
+	}
+}
+
+func TestIPFamilyColumn(t *testing.T) {
+	mapping := columnMapping{ipFamily: "ip_family"}
+	tests := []struct {
+		name    string
+		request map[string]any
+		want    string
+	}{
+		{"v4", map[string]any{"client_ip": "203.0.113.7"}, "v4"},
+		{"v6", map[string]any{"client_ip": "2001:db8::1"}, "v6"},
+		{"mapped v4", map[string]any{"client_ip": "::ffff:203.0.113.7"}, "v4"},
+		{"remote_ip fallback", map[string]any{"remote_ip": "2001:db8::1"}, "v6"},
+		{"client_ip preferred", map[string]any{"client_ip": "203.0.113.7", "remote_ip": "2001:db8::1"}, "v4"},
+		{"missing", map[string]any{}, "unknown"},
+		{"invalid", map[string]any{"client_ip": "not-an-ip"}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := applyTest(mapping, map[string]any{"request": tt.request})["ip_family"]; got != tt.want {
+			t.Errorf("%s: ip_family = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := applyTest(columnMapping{}, map[string]any{})["ip_family"]; ok {
+		t.Error("ip_family set without ip_family_column")
+	}
+}
+
+func TestJSONStringColumns(t *testing.T) {
+	mapping := columnMapping{jsonStrings: map[string]fieldPath{
+		"headers": mustParsePath("request.headers"),
+		"tags":    mustParsePath("tags"),
+		"note":    mustParsePath("note"),
+		"absent":  mustParsePath("missing"),
+	}}
+	row := applyTest(mapping, map[string]any{
+		"request": map[string]any{"headers": map[string]any{"Via": []any{"1.1 a"}, "Accept": []any{"*/*"}}},
+		"tags":    []any{"a", 1.0},
+		"note":    "plain",
+	})
+	for column, want := range map[string]any{
+		"headers": `{"Accept":["*/*"],"Via":["1.1 a"]}`,
+		"tags":    `["a",1]`,
+		"note":    "plain",
+	} {
+		if row[column] != want {
+			t.Errorf("%s = %v, want %v", column, row[column], want)
+		}
+	}
+	if _, ok := row["absent"]; ok {
+		t.Errorf("absent = %v, want no column for a missing field", row["absent"])
+	}
+}
+
+func TestDurationSecondsColumn(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration any
+		zero     any
+		null     any
+	}{
+		{"seconds", 0.25, 0.25, 0.25},
+		{"go duration", "1.5ms", 0.0015, 0.0015},
+		{"numeric string", "2", 2.0, 2.0},
+		{"missing", nil, 0.0, 0.0},
+		{"unparseable", "soon", 0.0, 0.0},
+		{"nan", "NaN", 0.0, nil},
+		{"infinite", "+Inf", 0.0, nil},
+	}
+	for _, tt := range tests {
+		fields := map[string]any{}
+		if tt.duration != nil {
+			fields["duration"] = tt.duration
+		}
+		zero := applyTest(columnMapping{durationSeconds: "duration_s"}, fields)["duration_s"]
+		null := applyTest(columnMapping{durationSeconds: "duration_s", durationNull: true}, fields)["duration_s"]
+		if zero != tt.zero || null != tt.null {
+			t.Errorf("%s: duration_s = %v with zero and %v with null, want %v and %v", tt.name, zero, null, tt.zero, tt.null)
+		}
+	}
+	if _, ok := applyTest(columnMapping{}, map[string]any{"duration": 1.0})["duration_s"]; ok {
+		t.Error("duration_s set without duration_seconds_column")
+	}
+}
+
+// A duration column named duration replaces the logged value, which must
+// not change when the row is mapped again.
+func TestDurationSecondsColumnReplacesField(t *testing.T) {
+	mapping := columnMapping{durationSeconds: "duration", durationNull: true}
+	row := bufferedRow{fields: map[string]any{"duration": "NaN"}}
+	for range 2 {
+		if got := mapping.apply(row)["duration"]; got != nil {
+			t.Fatalf("duration = %v, want nil", got)
+		}
+	}
+}
+
+func TestPathAndQueryColumns(t *testing.T) {
+	mapping := columnMapping{path: "path", query: "query"}
+	tests := []struct {
+		uri         any
+		path, query string
+	}{
+		{"/search?q=caddy&page=2", "/search", "q=caddy&page=2"},
+		{"/a%20b/c", "/a%20b/c", ""},
+		{"/empty?", "/empty", ""},
+		{"*", "*", ""},
+		{"no leading slash?x=1", "no leading slash?x=1", ""},
+		{nil, "", ""},
+	}
+	for _, tt := range tests {
+		request := map[string]any{}
+		if tt.uri != nil {
+			request["uri"] = tt.uri
+		}
+		row := applyTest(mapping, map[string]any{"request": request})
+		if row["path"] != tt.path || row["query"] != tt.query {
+			t.Errorf("%v: path = %q, query = %q, want %q and %q", tt.uri, row["path"], row["query"], tt.path, tt.query)
+		}
+	}
+
+	row := applyTest(columnMapping{query: "query"}, map[string]any{"request": map[string]any{"uri": "/?a=1"}})
+	if _, ok := row["path"]; ok || row["query"] != "a=1" {
+		t.Errorf("query_column alone: %v, want only the query column", row)
+	}
+}
+
+func TestCacheStatusColumn(t *testing.T) {
+	tests := []struct {
+		header any
+		want   string
+	}{
+		{"Souin; hit; ttl=120", cacheStatusHit},
+		{"Souin; fwd=uri-miss", cacheStatusMiss},
+		{"Souin; fwd=stale; fwd-status=304", cacheStatusMiss},
+		{"OriginCache; hit, EdgeCache; fwd=miss", cacheStatusMiss},
+		{"OriginCache; fwd=miss, EdgeCache; hit", cacheStatusHit},
+		{"HIT", cacheStatusHit},
+		{"miss", cacheStatusMiss},
+		{"Souin; detail=bypass", cacheStatusUnknown},
+		{nil, cacheStatusUnknown},
+	}
+	for _, tt := range tests {
+		headers := map[string]any{}
+		if tt.header != nil {
+			headers["Cache-Status"] = []any{tt.header}
+		}
+		fields := map[string]any{"resp_headers": headers}
+		if got := applyTest(columnMapping{cacheStatus: "cache"}, fields)["cache"]; got != tt.want {
+			t.Errorf("%v: cache = %v, want %s", tt.header, got, tt.want)
+		}
+		boolean := applyTest(columnMapping{cacheStatus: "cache", cacheStatusBool: true}, fields)["cache"]
+		if boolean != (tt.want == cacheStatusHit) {
+			t.Errorf("%v: cache = %v with cache_status_type bool, want %v", tt.header, boolean, tt.want == cacheStatusHit)
+		}
+	}
+	if _, ok := applyTest(columnMapping{}, map[string]any{})["cache"]; ok {
+		t.Error("cache set without cache_status_column")
+	}
+}
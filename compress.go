@@ -0,0 +1,132 @@
+package chwriter
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pierrec/lz4/v4"
+	"go.uber.org/zap"
+)
+
+// packedRow is a buffered log line stored LZ4 compressed, along with the
+// values Write added to its fields, which cannot be derived from the line
+// again when it is decoded.
+type packedRow struct {
+	// data is the line compressed as an LZ4 block, and size its length.
+	data []byte
+	size int
+	// sequence and hash are the values of sequence_column and hash_column,
+	// if set.
+	sequence uint64
+	hash     any
+}
+
+// rowPacker compresses the rows Write buffers over buffer_compress_threshold.
+// Write compresses a line before it takes bufferMu and only swaps the result
+// in while holding it. Compressors are pooled for concurrent writers and
+// allocated on first use, so that writers that never compress do not pay
+// for their hash tables.
+type rowPacker struct {
+	// over is set while the buffer holds at least buffer_compress_threshold
+	// rows, see updatePacking, and tells Write to compress the next line.
+	over    atomic.Bool
+	scratch sync.Pool
+}
+
+// pack returns line compressed, along with the value of hashColumn in
+// fields, if set. Write sets the sequence number under bufferMu. A line that
+// LZ4 cannot shrink is still stored compressed, as it takes up far less
+// memory than its decoded fields. pack returns nil if compression fails,
+// and the row is then buffered decoded.
+func (p *rowPacker) pack(line []byte, fields map[string]any, hashColumn string) *packedRow {
+	scratch, _ := p.scratch.Get().(*packScratch)
+	if scratch == nil {
+		scratch = &packScratch{}
+	}
+	defer p.scratch.Put(scratch)
+
+	if bound := lz4.CompressBlockBound(len(line)); len(scratch.buf) < bound {
+		scratch.buf = make([]byte, bound)
+	}
+	n, err := scratch.compressor.CompressBlock(line, scratch.buf)
+	if err != nil || n == 0 {
+		return nil
+	}
+	packed := &packedRow{data: bytes.Clone(scratch.buf[:n]), size: len(line)}
+	if hashColumn != "" {
+		packed.hash = fields[hashColumn]
+	}
+	return packed
+}
+
+// packScratch is a compressor and the buffer it compresses into.
+type packScratch struct {
+	compressor lz4.Compressor
+	buf        []byte
+}
+
+// updatePacking has Write compress rows from now on if the buffer is at or
+// over buffer_compress_threshold, and stop if it is not. It must be called
+// with bufferMu held whenever the buffer grows or shrinks.
+func (conn *clickhouseConn) updatePacking() {
+	if conn.compressAt > 0 {
+		conn.packer.over.Store(len(conn.buffer) >= conn.compressAt)
+	}
+}
+
+// unpack decompresses and decodes a packed row, restoring the fields Write
+// set and, for on_extra_field route_raw, the raw line. The row keeps its
+// packed form, see repackRows.
+func (conn *clickhouseConn) unpack(row bufferedRow) (bufferedRow, error) {
+	line := make([]byte, row.packed.size)
+	if _, err := lz4.UncompressBlock(row.packed.data, line); err != nil {
+		return row, fmt.Errorf("failed to decompress buffered row: %w", err)
+	}
+	fields, err := conn.decodeLine(line)
+	if err != nil {
+		return row, err
+	}
+	if conn.sequenceColumn != "" {
+		fields[conn.sequenceColumn] = row.packed.sequence
+	}
+	if conn.hasher.column != "" {
+		fields[conn.hasher.column] = row.packed.hash
+	}
+	row.fields = fields
+	if conn.extraFields == extraFieldRouteRaw {
+		row.raw = line
+	}
+	return row, nil
+}
+
+// unpackRows decodes the packed rows among rows in place and returns rows.
+// A row that cannot be decoded, which only corrupted memory could cause, is
+// dropped with an error log.
+func (conn *clickhouseConn) unpackRows(rows []bufferedRow) []bufferedRow {
+	kept := rows[:0]
+	for _, row := range rows {
+		if row.packed != nil {
+			var err error
+			if row, err = conn.unpack(row); err != nil {
+				conn.logger.Error("dropping buffered row that could not be decoded", zap.String("writer", conn.key), zap.Error(err))
+				continue
+			}
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
+
+// repackRows drops the decoded fields of the packed rows among rows, so that
+// rows put back in the buffer after a failed flush do not take up more
+// memory than they did before it. It returns rows.
+func repackRows(rows []bufferedRow) []bufferedRow {
+	for i := range rows {
+		if rows[i].packed != nil {
+			rows[i].fields, rows[i].raw = nil, nil
+		}
+	}
+	return rows
+}
@@ -0,0 +1,222 @@
+package chwriter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+var compressLines = []string{
+	`{"uri":"/a","status":200,"request":{"host":"example.com","headers":{"Accept":["*/*"]}}}`,
+	`{"uri":"/b","status":404,"request":{"host":"example.com","headers":{"Accept":["text/html"]}}}`,
+	`"not an object, wrapped into the line column by non_object wrap"`,
+	`{"uri":"/c","status":500,"size":12345678901,"request":{"host":"example.com","headers":{}}}`,
+}
+
+// compressTestConn returns a writer that sets the fields Write adds to
+// rows, with buffer_compress_threshold compressAt.
+func compressTestConn(fake *fakeConn, compressAt int) *clickhouseConn {
+	conn := newTestConn(fake)
+	conn.compressAt = compressAt
+	conn.sequenceColumn = "seq"
+	conn.hasher = rowHasher{column: "hash", algorithm: hashXXHash}
+	conn.nonObject = nonObjectWrap
+	conn.nonObjectCol = "line"
+	conn.extraFields = extraFieldRouteRaw
+	conn.rawColumn = "raw"
+	return conn
+}
+
+// Rows written over the threshold are stored compressed and decode to the
+// same fields and raw line as rows that were never compressed.
+func TestPackedRowsDecodeUnchanged(t *testing.T) {
+	plain := compressTestConn(newFakeConn(), 0)
+	packed := compressTestConn(newFakeConn(), 1)
+	for _, line := range compressLines {
+		for _, conn := range []*clickhouseConn{plain, packed} {
+			if _, err := conn.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i, row := range packed.buffer {
+		if compressed := row.packed != nil; compressed != (i > 0) {
+			t.Errorf("row %d: compressed = %t, want %t", i, compressed, i > 0)
+		}
+		if row.packed != nil && (row.fields != nil || row.raw != nil) {
+			t.Errorf("row %d: compressed row keeps its decoded fields", i)
+		}
+	}
+	want := plain.unpackRows(plain.buffer)
+	got := packed.unpackRows(packed.buffer)
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d rows, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i].fields, want[i].fields) {
+			t.Errorf("row %d: fields = %v, want %v", i, got[i].fields, want[i].fields)
+		}
+		if !bytes.Equal(got[i].raw, want[i].raw) {
+			t.Errorf("row %d: raw = %q, want %q", i, got[i].raw, want[i].raw)
+		}
+		if got[i].receivedAt.IsZero() {
+			t.Errorf("row %d: lost its receive time", i)
+		}
+	}
+}
+
+// Rows put back after a failed flush are compressed again, and sent with
+// the values Write gave them once the server is back.
+func TestPackedRowsSurviveFailedFlush(t *testing.T) {
+	fake := newFakeConn("uri String", "seq UInt64")
+	conn := compressTestConn(fake, 1)
+	conn.extraFields = extraFieldIgnore
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		if _, err := conn.Write([]byte(`{"uri":"` + uri + `"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake.failSends(errors.New("server unavailable"))
+	if err := conn.flush(context.Background()); err == nil {
+		t.Fatal("flush succeeded, want the injected error")
+	}
+	if len(conn.buffer) != 3 {
+		t.Fatalf("%d rows put back, want 3", len(conn.buffer))
+	}
+	for i, row := range conn.buffer[1:] {
+		if row.packed == nil || row.fields != nil {
+			t.Errorf("row %d put back decoded", i+1)
+		}
+	}
+
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rows := fake.rows()
+	if len(rows) != 3 {
+		t.Fatalf("sent %d rows, want 3", len(rows))
+	}
+	for i, uri := range []string{"/a", "/b", "/c"} {
+		if rows[i][0] != uri || rows[i][1] != uint64(i+1) {
+			t.Errorf("row %d = %v, want [%s %d]", i, rows[i], uri, i+1)
+		}
+	}
+}
+
+// Writers compress their lines concurrently, outside the buffer lock, and
+// every row still decodes with its own sequence number.
+func TestPackedRowsConcurrentWrites(t *testing.T) {
+	conn := compressTestConn(newFakeConn(), 1)
+	const writers, lines = 4, 200
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range lines {
+				if _, err := conn.Write(benchLine); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	rows := conn.unpackRows(conn.buffer)
+	if len(rows) != writers*lines {
+		t.Fatalf("decoded %d rows, want %d", len(rows), writers*lines)
+	}
+	seen := make(map[uint64]bool)
+	for i, row := range rows {
+		sequence, _ := row.fields["seq"].(uint64)
+		if sequence == 0 || seen[sequence] {
+			t.Fatalf("row %d: sequence %v missing or repeated", i, row.fields["seq"])
+		}
+		seen[sequence] = true
+		if row.fields["msg"] != "handled request" {
+			t.Fatalf("row %d decoded to %v", i, row.fields)
+		}
+	}
+}
+
+// Compressed rows are decoded before max_row_staleness looks at their
+// timestamp.
+func TestPackedRowsDropStale(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := newTestConn(fake)
+	conn.compressAt = 1
+	conn.maxRowStaleness = 1
+	conn.columns.timestampPath = mustParsePath("ts")
+	for _, line := range []string{`{"uri":"/a","ts":1}`, `{"uri":"/b","ts":1}`} {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.stats.staleRowsDropped; n != 2 {
+		t.Errorf("staleRowsDropped = %d, want 2", n)
+	}
+	if rows := fake.rows(); len(rows) != 0 {
+		t.Errorf("sent %d stale rows", len(rows))
+	}
+}
+
+// BenchmarkBufferCompression compares buffering rows decoded with buffering
+// them compressed. ns/op is the CPU cost of writing a line and decoding it
+// for its flush, and buffered-B/row the heap a buffered row takes up.
+func BenchmarkBufferCompression(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		compressAt int
+	}{
+		{"decoded", 0},
+		{"compressed", 1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn := newTestConn(newFakeConn())
+			conn.compressAt = bench.compressAt
+			perRow := bufferedBytesPerRow(b, conn)
+
+			b.SetBytes(int64(len(benchLine)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				if _, err := conn.Write(benchLine); err != nil {
+					b.Fatal(err)
+				}
+				if len(conn.buffer) == 1000 {
+					conn.unpackRows(conn.buffer)
+					conn.buffer = conn.buffer[:0]
+				}
+			}
+			b.ReportMetric(perRow, "buffered-B/row")
+		})
+	}
+}
+
+// bufferedBytesPerRow returns how much the heap grows per row while conn
+// buffers benchLine, and empties the buffer again.
+func bufferedBytesPerRow(b *testing.B, conn *clickhouseConn) float64 {
+	const rows = 10000
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for range rows {
+		if _, err := conn.Write(benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	conn.buffer = []bufferedRow{}
+	return float64(after.HeapAlloc-before.HeapAlloc) / rows
+}
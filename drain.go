@@ -0,0 +1,102 @@
+package chwriter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// drainer flushes the rows left behind by writers closed in close_mode
+// background and then closes their connections. Each closed writer is
+// drained in its own goroutine, so that a writer whose server is down does
+// not hold up the others. When the process exits, the drainer stops waiting
+// between attempts and Caddy waits for every drain to make its last one,
+// see wait.
+type drainer struct {
+	wg       sync.WaitGroup
+	register sync.Once
+	exit     chan struct{}
+}
+
+// backgroundDrainer is the drainer shared by all writers.
+var backgroundDrainer = drainer{exit: make(chan struct{})}
+
+// submit starts draining a closed connection.
+func (dr *drainer) submit(conn *clickhouseConn) {
+	dr.register.Do(func() {
+		caddy.OnExit(dr.wait)
+	})
+
+	dr.wg.Add(1)
+	go func() {
+		defer dr.wg.Done()
+		conn.drain(dr.exit)
+	}()
+}
+
+// wait is registered with caddy.OnExit. It has the drains in progress make
+// their last attempt right away and waits for them, or until ctx is done.
+func (dr *drainer) wait(ctx context.Context) {
+	close(dr.exit)
+	done := make(chan struct{})
+	go func() {
+		dr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// drain flushes the buffer of a closed connection, retrying failed flushes
+// every flush interval for as long as the process runs, and then closes the
+// connection. Once exit is closed, a flush in progress or the next one made
+// right away is the last, as the final flush of Close in close_mode flush
+// would be, and rows it could not send are dropped with an error log.
+func (conn *clickhouseConn) drain(exit <-chan struct{}) {
+	var err error
+	exiting := false
+	for attempt := 1; ; attempt++ {
+		if err = conn.drainAttempt(); err == nil {
+			break
+		}
+		conn.logger.Warn("background flush after close failed",
+			zap.String("writer", conn.key), zap.Int("attempt", attempt), zap.Error(err))
+		if exiting {
+			break
+		}
+		select {
+		case <-time.After(conn.retryDelay(conn.flushInterval)):
+		case <-exit:
+			exiting = true
+		}
+	}
+	if err != nil {
+		conn.bufferMu.Lock()
+		dropped := len(conn.buffer)
+		conn.buffer = nil
+		conn.bufferMu.Unlock()
+		conn.logger.Error("dropping rows that could not be flushed after close",
+			zap.String("writer", conn.key), zap.Int("rows", dropped), zap.Error(err))
+	}
+	if err := conn.closeConns(); err != nil {
+		conn.logger.Warn("failed to close connection", zap.String("writer", conn.key), zap.Error(err))
+	}
+}
+
+// drainAttempt flushes the buffer of a closed connection. It first replaces
+// the connections with fresh ones, see reconnect, since those of the closed
+// writer may have gone stale while the server was unreachable. If no fresh
+// connection can be opened, it flushes on the existing ones, which may well
+// still work.
+func (conn *clickhouseConn) drainAttempt() error {
+	if err := conn.reconnect(); err != nil {
+		conn.logger.Warn("failed to reconnect for background flush, flushing on the existing connection",
+			zap.String("writer", conn.key), zap.Error(err))
+	}
+	return conn.flush(context.Background())
+}
@@ -0,0 +1,95 @@
+package chwriter
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// unreachableOptions returns driver options for an address nothing listens
+// on, so that dialing fails right away.
+func unreachableOptions(t *testing.T) *clickhouse.Options {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return &clickhouse.Options{Addr: []string{addr}, DialTimeout: time.Second}
+}
+
+// On exit a drain waiting to retry makes its last attempt right away, and
+// the exit waits for it to drop the rows and close the connection.
+func TestDrainerWaitEndsRetries(t *testing.T) {
+	dr := drainer{exit: make(chan struct{})}
+	var fakes []*fakeConn
+	var conns []*clickhouseConn
+	for range 2 {
+		fake := newFakeConn("uri String")
+		fake.failSends(errors.New("server unavailable"), errors.New("server unavailable"))
+		conn := newTestConn(fake)
+		conn.flushInterval = time.Hour
+		conn.options = unreachableOptions(t)
+		conn.buffer = []bufferedRow{{fields: map[string]any{"uri": "/"}}}
+		fakes = append(fakes, fake)
+		conns = append(conns, conn)
+		dr.submit(conn)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dr.wait(t.Context())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("wait did not return, drains are still waiting out the flush interval")
+	}
+	for i, conn := range conns {
+		if n := len(conn.buffer); n != 0 {
+			t.Errorf("writer %d: %d rows left after the drain gave up", i, n)
+		}
+		if !fakes[i].isClosed() {
+			t.Errorf("writer %d: connection not closed", i)
+		}
+	}
+}
+
+// A drain whose fresh connection cannot be opened flushes on the existing
+// one instead of wasting the attempt.
+func TestDrainFlushesOnExistingConnection(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := newTestConn(fake)
+	conn.options = unreachableOptions(t)
+	conn.buffer = []bufferedRow{{fields: map[string]any{"uri": "/"}}}
+
+	conn.drain(make(chan struct{}))
+	if rows := fake.rows(); len(rows) != 1 {
+		t.Errorf("sent %d rows, want 1", len(rows))
+	}
+	if !fake.isClosed() {
+		t.Errorf("connection not closed")
+	}
+}
+
+// A drain keeps retrying until the rows are sent, however many attempts it
+// takes.
+func TestDrainRetriesUntilSent(t *testing.T) {
+	fake := newFakeConn("uri String")
+	for range 10 {
+		fake.failSends(errors.New("server unavailable"))
+	}
+	conn := newTestConn(fake)
+	conn.flushInterval = time.Millisecond
+	conn.options = unreachableOptions(t)
+	conn.buffer = []bufferedRow{{fields: map[string]any{"uri": "/"}}}
+
+	conn.drain(make(chan struct{}))
+	if rows := fake.rows(); len(rows) != 1 {
+		t.Errorf("sent %d rows, want 1", len(rows))
+	}
+}
@@ -0,0 +1,163 @@
+package chwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/column"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"go.uber.org/zap"
+)
+
+// fakeConn stands in for a ClickHouse server in tests. Batches have the
+// columns of table, given as "name Type", and values are appended to the
+// driver's own column implementations, so they are converted and rejected
+// as they would be by a real server connection. Methods the writer does not
+// use in a test panic through the nil embedded Conn. An INSERT that lists
+// its columns gets a batch of just those.
+type fakeConn struct {
+	driver.Conn
+	table []string
+
+	mu       sync.Mutex
+	sendErrs []error
+	pingErr  error
+	queries  []string
+	sent     [][]any
+	batches  [][][]any
+	closed   bool
+}
+
+func newFakeConn(table ...string) *fakeConn {
+	return &fakeConn{table: table}
+}
+
+// failSends makes the next sends fail with errs, in order.
+func (f *fakeConn) failSends(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sendErrs = append(f.sendErrs, errs...)
+}
+
+// sentBatches returns the rows of each batch sent so far, by batch.
+func (f *fakeConn) sentBatches() [][][]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][][]any(nil), f.batches...)
+}
+
+// rows returns the rows of all batches sent so far.
+func (f *fakeConn) rows() [][]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]any(nil), f.sent...)
+}
+
+func (f *fakeConn) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, errors.New("connection is closed")
+	}
+	f.queries = append(f.queries, query)
+
+	var listed map[string]bool
+	if i := strings.LastIndex(query, " ("); i >= 0 && strings.HasSuffix(query, ")") {
+		listed = make(map[string]bool)
+		for _, name := range strings.Split(query[i+2:len(query)-1], ", ") {
+			listed[strings.Trim(name, "`")] = true
+		}
+	}
+
+	batch := &fakeBatch{conn: f}
+	for _, definition := range f.table {
+		name, typ, _ := strings.Cut(definition, " ")
+		if listed != nil && !listed[name] {
+			continue
+		}
+		col, err := column.Type(typ).Column(name, time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		batch.columns = append(batch.columns, col)
+	}
+	return batch, nil
+}
+
+func (f *fakeConn) Ping(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pingErr
+}
+
+func (f *fakeConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+type fakeBatch struct {
+	driver.Batch
+	conn    *fakeConn
+	columns []column.Interface
+	rows    [][]any
+}
+
+func (b *fakeBatch) Append(values ...any) error {
+	if len(values) != len(b.columns) {
+		return fmt.Errorf("expected %d arguments, got %d", len(b.columns), len(values))
+	}
+	for i, col := range b.columns {
+		if err := col.AppendRow(values[i]); err != nil {
+			return fmt.Errorf("clickhouse [AppendRow]: %s: %w", col.Name(), err)
+		}
+	}
+	b.rows = append(b.rows, values)
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	b.conn.mu.Lock()
+	defer b.conn.mu.Unlock()
+	if len(b.conn.sendErrs) > 0 {
+		err := b.conn.sendErrs[0]
+		b.conn.sendErrs = b.conn.sendErrs[1:]
+		return err
+	}
+	b.conn.sent = append(b.conn.sent, b.rows...)
+	b.conn.batches = append(b.conn.batches, b.rows)
+	return nil
+}
+
+func (b *fakeBatch) Columns() []column.Interface { return b.columns }
+func (b *fakeBatch) Close() error                { return nil }
+func (b *fakeBatch) Abort() error                { return nil }
+
+// newTestConn returns a writer connection to fake with the defaults that
+// Provision and OpenWriter would set, without starting its loops.
+func newTestConn(fake *fakeConn) *clickhouseConn {
+	return &clickhouseConn{
+		Conn:            fake,
+		key:             "test",
+		table:           "logs",
+		buffer:          []bufferedRow{},
+		flushSem:        make(chan struct{}, 1),
+		flushInterval:   time.Second,
+		maxBackpressure: defaultMaxBackpressure,
+		closeMode:       closeModeFlush,
+		extraFields:     extraFieldIgnore,
+		logger:          zap.NewNop(),
+		done:            make(chan struct{}),
+	}
+}
@@ -0,0 +1,50 @@
+package chwriter
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// Values of the dual_write_policy option.
+const (
+	dualWriteAny  = "any"
+	dualWriteBoth = "both"
+)
+
+// dualWriteResult combines the outcomes of sending a batch to the primary
+// and the dual_write server according to the policy. Batches that only one
+// server accepted are logged and counted as partial writes.
+func (conn *clickhouseConn) dualWriteResult(primaryErr, secondaryErr error) error {
+	if primaryErr == nil && secondaryErr == nil {
+		return nil
+	}
+	if secondaryErr != nil {
+		secondaryErr = fmt.Errorf("dual_write server: %w", secondaryErr)
+	}
+	if primaryErr != nil && secondaryErr != nil {
+		return errors.Join(primaryErr, secondaryErr)
+	}
+
+	conn.bufferMu.Lock()
+	conn.stats.partialWrites++
+	conn.bufferMu.Unlock()
+
+	failed := errors.Join(primaryErr, secondaryErr)
+	if conn.bothRequired {
+		return failed
+	}
+	conn.logger.Warn("batch was only accepted by one of the dual_write servers", zap.String("writer", conn.key), zap.Error(failed))
+	return nil
+}
+
+// closeConns closes the connection to the primary and, with dual_write, the
+// secondary server.
+func (conn *clickhouseConn) closeConns() error {
+	err := conn.Conn.Close()
+	if conn.secondary != nil {
+		err = errors.Join(err, conn.secondary.Close())
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package chwriter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/proto"
+)
+
+// authErrorCodes are the server exception codes returned for rejected
+// credentials: UNKNOWN_USER, WRONG_PASSWORD, REQUIRED_PASSWORD and
+// AUTHENTICATION_FAILED.
+var authErrorCodes = map[int32]bool{
+	192: true,
+	193: true,
+	194: true,
+	516: true,
+}
+
+// isAuthError reports whether err is the server rejecting the credentials.
+func isAuthError(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && authErrorCodes[exception.Code]
+}
+
+// wrapAuthError annotates err with an actionable message if the server
+// rejected the credentials of username. Other errors are returned unchanged.
+func wrapAuthError(err error, username string) error {
+	if !isAuthError(err) {
+		return err
+	}
+	if username == "" {
+		// The driver logs in as the default user when none is configured.
+		username = "default"
+	}
+	return fmt.Errorf("authentication failed for ClickHouse user %q, check the configured username and password: %w", username, err)
+}
+
+// exceptionColumnPattern extracts the column named in server exceptions such
+// as "Cannot parse input ... for column 'status'" or "No such column ts".
+var exceptionColumnPattern = regexp.MustCompile("(?i)\\bcolumn\\s+[`'\"]?([A-Za-z_][A-Za-z0-9_.]*)")
+
+// errorColumn returns the name of the column an insert error is attributed
+// to, or an empty string if the error does not name one. Errors raised by
+// the driver while encoding a row carry the column explicitly; for errors
+// returned by the server the column is taken from the exception message.
+func errorColumn(err error) string {
+	var blockErr *proto.BlockError
+	if errors.As(err, &blockErr) && blockErr.ColumnName != "" {
+		return blockErr.ColumnName
+	}
+	var opErr *clickhouse.OpError
+	if errors.As(err, &opErr) && opErr.ColumnName != "" {
+		return opErr.ColumnName
+	}
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		if match := exceptionColumnPattern.FindStringSubmatch(exception.Message); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// tooManyPartsCode is the server exception code TOO_MANY_PARTS, returned when
+// inserts create parts faster than the table's merges can absorb them.
+const tooManyPartsCode = 252
+
+// isTooManyParts reports whether err is a TOO_MANY_PARTS rejection, which
+// retrying at the same rate only makes worse.
+func isTooManyParts(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && exception.Code == tooManyPartsCode
+}
+
+// memoryLimitExceededCode is the server exception code MEMORY_LIMIT_EXCEEDED.
+const memoryLimitExceededCode = 241
+
+// isMemoryLimitExceeded reports whether err is the server running out of
+// memory, which a smaller insert may avoid.
+func isMemoryLimitExceeded(err error) bool {
+	var exception *clickhouse.Exception
+	return errors.As(err, &exception) && exception.Code == memoryLimitExceededCode
+}
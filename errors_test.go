@@ -0,0 +1,95 @@
+package chwriter
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"go.uber.org/zap"
+)
+
+func TestWrapAuthError(t *testing.T) {
+	for _, code := range []int32{192, 193, 194, 516} {
+		err := wrapAuthError(&clickhouse.Exception{Code: code}, "")
+		if !strings.Contains(err.Error(), `ClickHouse user "default"`) {
+			t.Errorf("code %d: %v, want an authentication error for the default user", code, err)
+		}
+		var exception *clickhouse.Exception
+		if !errors.As(err, &exception) {
+			t.Errorf("code %d: wrapped error does not unwrap to the exception", code)
+		}
+	}
+	other := &clickhouse.Exception{Code: 60}
+	if err := wrapAuthError(other, "alice"); err != error(other) {
+		t.Errorf("code 60: %v, want the error unchanged", err)
+	}
+}
+
+// rejectingServer accepts native protocol connections and answers the
+// client's hello with an AUTHENTICATION_FAILED exception.
+func rejectingServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var packet []byte
+	packet = append(packet, 2) // ServerException
+	packet = binary.LittleEndian.AppendUint32(packet, 516)
+	for _, s := range []string{"DB::Exception", "alice: Authentication failed", ""} {
+		packet = binary.AppendUvarint(packet, uint64(len(s)))
+		packet = append(packet, s...)
+	}
+	packet = append(packet, 0) // not nested
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Read(make([]byte, 4096))
+				c.Write(packet)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// clickhouse.Open does not dial, so OpenWriter has to ping the server to
+// report rejected credentials.
+func TestOpenWriterReportsRejectedCredentials(t *testing.T) {
+	host, port, _ := net.SplitHostPort(rejectingServer(t))
+	writer := &ClickHouseWriter{Host: host, Port: port, Username: "alice", Table: "logs", logger: zap.NewNop()}
+
+	w, err := writer.OpenWriter()
+	if err == nil {
+		w.Close()
+		t.Fatal("OpenWriter succeeded, want an authentication error")
+	}
+	if !strings.Contains(err.Error(), `authentication failed for ClickHouse user "alice"`) {
+		t.Errorf("OpenWriter: %v, want an authentication error for alice", err)
+	}
+}
+
+// A server that cannot be reached must not keep Caddy from starting, since
+// rows are buffered until it is back.
+func TestOpenWriterToleratesUnreachableServer(t *testing.T) {
+	host, port, _ := net.SplitHostPort(unreachableOptions(t).Addr[0])
+	writer := &ClickHouseWriter{Host: host, Port: port, Table: "logs", CloseMode: closeModeDrop, logger: zap.NewNop()}
+
+	w, err := writer.OpenWriter()
+	if err != nil {
+		t.Fatalf("OpenWriter: %v, want the writer to open and buffer rows", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Errorf("Write: %v, want the row buffered", err)
+	}
+}
@@ -0,0 +1,44 @@
+package chwriter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// requestURIField is the field of Caddy's access log that holds the request
+// URI, including the query string.
+var requestURIField = mustParsePath("request.uri")
+
+// validateURIPatterns checks that every drop_uri_patterns entry is a valid
+// path.Match pattern.
+func validateURIPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid drop_uri_patterns pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// droppedURI reports whether the request URI of row matches one of
+// patterns. A pattern matches if it matches either the whole URI or its path
+// without the query string, so "/healthz" also drops "/healthz?full=1".
+// Lines without a request URI are never dropped.
+func droppedURI(row map[string]any, patterns []string) bool {
+	uri, _ := requestURIField.lookup(row).(string)
+	if uri == "" {
+		return false
+	}
+	uriPath, _, _ := strings.Cut(uri, "?")
+	for _, pattern := range patterns {
+		// The patterns were validated when the writer was provisioned.
+		if ok, _ := path.Match(pattern, uri); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, uriPath); ok {
+			return true
+		}
+	}
+	return false
+}
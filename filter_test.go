@@ -0,0 +1,50 @@
+package chwriter
+
+import "testing"
+
+func TestDroppedURI(t *testing.T) {
+	patterns := []string{"/healthz", "/internal/*"}
+	tests := []struct {
+		uri  any
+		want bool
+	}{
+		{"/healthz", true},
+		{"/healthz?full=1", true},
+		{"/internal/metrics", true},
+		{"/internal/a/b", false},
+		{"/healthz/deep", false},
+		{"/", false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		request := map[string]any{}
+		if tt.uri != nil {
+			request["uri"] = tt.uri
+		}
+		if got := droppedURI(map[string]any{"request": request}, patterns); got != tt.want {
+			t.Errorf("droppedURI(%v) = %v, want %v", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestWriteDropsURIs(t *testing.T) {
+	conn := newTestConn(newFakeConn())
+	conn.dropURIs = []string{"/healthz"}
+	for _, line := range []string{`{"request":{"uri":"/healthz"}}`, `{"request":{"uri":"/"}}`, `{"msg":"no request"}`} {
+		if n, err := conn.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write(%s) = %d, %v", line, n, err)
+		}
+	}
+	if len(conn.buffer) != 2 || conn.stats.rowsFiltered != 1 {
+		t.Errorf("%d rows buffered and %d filtered, want 2 and 1", len(conn.buffer), conn.stats.rowsFiltered)
+	}
+}
+
+func TestValidateURIPatterns(t *testing.T) {
+	if err := validateURIPatterns([]string{"/healthz", "/api/*"}); err != nil {
+		t.Errorf("valid patterns: %v", err)
+	}
+	if err := validateURIPatterns([]string{"/[unterminated"}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
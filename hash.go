@@ -0,0 +1,54 @@
+package chwriter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Values of the hash_algorithm option.
+const (
+	hashXXHash = "xxhash"
+	hashSHA256 = "sha256"
+)
+
+// rowHasher stores a hash of each log line in a column: a UInt64 for xxhash
+// or a 64 character hex string for sha256.
+type rowHasher struct {
+	column    string
+	algorithm string
+	fields    []string
+	paths     []fieldPath
+}
+
+// apply sets the hash column of row if it is configured. Without fields,
+// the raw line is hashed, minus surrounding whitespace such as the trailing
+// newline. With fields, the hash covers only the values at those field
+// paths, encoded as a JSON object whose keys are sorted, so it is stable
+// across changes to unrelated fields and to key order. Missing fields are
+// hashed as null.
+func (h *rowHasher) apply(raw []byte, row map[string]any) {
+	if h.column == "" {
+		return
+	}
+
+	data := bytes.TrimSpace(raw)
+	if len(h.fields) > 0 {
+		subset := make(map[string]any, len(h.fields))
+		for i, field := range h.fields {
+			subset[field] = h.paths[i].lookup(row)
+		}
+		// Values decoded from JSON always encode again.
+		data, _ = json.Marshal(subset)
+	}
+
+	if h.algorithm == hashSHA256 {
+		sum := sha256.Sum256(data)
+		row[h.column] = hex.EncodeToString(sum[:])
+		return
+	}
+	row[h.column] = xxhash.Sum64(data)
+}
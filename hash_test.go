@@ -0,0 +1,64 @@
+package chwriter
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// hashLine decodes line and returns the hash h stores for it.
+func hashLine(t *testing.T, h rowHasher, line string) any {
+	t.Helper()
+	var row map[string]any
+	if err := json.Unmarshal([]byte(line), &row); err != nil {
+		t.Fatal(err)
+	}
+	h.apply([]byte(line), row)
+	return row[h.column]
+}
+
+func TestHashColumnRawLine(t *testing.T) {
+	h := rowHasher{column: "hash", algorithm: hashXXHash}
+	sum, ok := hashLine(t, h, `{"uri":"/a"}`).(uint64)
+	if !ok {
+		t.Fatalf("xxhash: %T, want uint64", hashLine(t, h, `{"uri":"/a"}`))
+	}
+	if got := hashLine(t, h, `{"uri":"/a"}`+"\n"); got != sum {
+		t.Error("trailing newline changes the hash")
+	}
+	if got := hashLine(t, h, `{"uri":"/b"}`); got == sum {
+		t.Error("different lines hash the same")
+	}
+
+	h.algorithm = hashSHA256
+	if hex, _ := hashLine(t, h, `{"uri":"/a"}`).(string); len(hex) != 64 {
+		t.Errorf("sha256: %q, want 64 hex characters", hex)
+	}
+}
+
+func TestHashColumnFields(t *testing.T) {
+	fields := []string{"request.uri", "status"}
+	h := rowHasher{column: "hash", algorithm: hashXXHash, fields: fields, paths: testPaths(fields)}
+
+	sum := hashLine(t, h, `{"request":{"uri":"/a"},"status":200,"ts":1}`)
+	if got := hashLine(t, h, `{"ts":2,"status":200,"request":{"uri":"/a","host":"x"}}`); got != sum {
+		t.Error("unrelated fields or key order change the hash")
+	}
+	if got := hashLine(t, h, `{"request":{"uri":"/a"},"status":404}`); got == sum {
+		t.Error("a hashed field does not change the hash")
+	}
+	missing := hashLine(t, h, `{"request":{"uri":"/a"}}`)
+	if missing == sum {
+		t.Error("a missing field hashes the same as a present one")
+	}
+	if got := hashLine(t, h, `{"request":{"uri":"/a"},"status":null}`); got != missing {
+		t.Error("a missing field does not hash as null")
+	}
+}
+
+func TestHashColumnUnset(t *testing.T) {
+	row := map[string]any{"uri": "/"}
+	(&rowHasher{algorithm: hashXXHash}).apply([]byte(`{"uri":"/"}`), row)
+	if len(row) != 1 {
+		t.Errorf("row = %v, want no hash column without hash_column", row)
+	}
+}
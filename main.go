@@ -1,18 +1,26 @@
 package chwriter
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -27,8 +35,416 @@ type ClickHouseWriter struct {
 	Username      string         `json:"username"`
 	Password      string         `json:"password"`
 	Port          string         `json:"port"`
-	TLS           string         `json:"tls"`
+	TLS           tlsSetting     `json:"tls"`
 	FlushInterval caddy.Duration `json:"flush_interval"`
+
+	// TLSMinVersion is the lowest TLS version ("1.0" to "1.3") the
+	// connection accepts, and TLSCipherSuites restricts the cipher suites
+	// offered for TLS 1.2 and below, see validateTLS. By default Go's own
+	// defaults apply. Both require TLS.
+	TLSMinVersion   string   `json:"tls_min_version"`
+	TLSCipherSuites []string `json:"tls_cipher_suites"`
+
+	// ReconnectInterval replaces the connections to the server with new
+	// ones at this interval, resolving the host name again, so that a
+	// long running writer follows DNS changes and spreads over the
+	// servers behind a load balancer. A flush in progress is finished on
+	// the old connection first. Zero, the default, keeps the connections
+	// for the lifetime of the writer.
+	ReconnectInterval caddy.Duration `json:"reconnect_interval"`
+
+	// Protocol is either "native" (the default) or "http". Compression
+	// selects how inserted data is compressed, see compressionMethods. Over
+	// HTTP, gzip, deflate and br compress the entire request body which
+	// greatly reduces the bandwidth of large JSON-heavy batches at the cost
+	// of client CPU, with gzip being the usual balance between the two.
+	Protocol    string `json:"protocol"`
+	Compression string `json:"compression"`
+
+	// StatsTable, if set, is a table that periodically receives a row of
+	// the writer's own operational stats. See statsRow for its columns.
+	StatsTable    string         `json:"stats_table"`
+	StatsInterval caddy.Duration `json:"stats_interval"`
+
+	// AtRiskRows and AtRiskAge mark the writer as at risk in the stats once
+	// at least that many rows have not been sent yet, or the oldest of them
+	// was received at least that long ago. These are the rows a crash would
+	// lose. Each stats row of an at risk writer is also logged as a
+	// warning. Both require StatsTable and are disabled by default.
+	AtRiskRows int            `json:"at_risk_rows"`
+	AtRiskAge  caddy.Duration `json:"at_risk_age"`
+
+	// NonObject controls what happens to log lines that decode to a JSON
+	// scalar or array rather than an object: "error" (the default) rejects
+	// them, "skip" silently drops them and "wrap" stores the value in
+	// NonObjectColumn.
+	NonObject       string `json:"non_object"`
+	NonObjectColumn string `json:"non_object_column"`
+
+	// VerifyInserts counts the rows of the table before and after every
+	// flush and reports flushes where fewer rows landed than were sent, for
+	// instance because of insert deduplication. It costs two extra queries
+	// per flush and only detects shortfalls, since concurrent inserts from
+	// other clients also raise the count.
+	VerifyInserts bool `json:"verify_inserts"`
+
+	// Key overrides the computed WriterKey. Caddy opens one writer per key
+	// and shares it between all logs that reference the same key, so two
+	// writers with the same Key share a single connection and buffer (the
+	// settings of whichever is opened first apply), while distinct keys
+	// always get separate connections even if they are configured alike.
+	Key string `json:"writer_key"`
+
+	// LowPriority runs the writer's queries with the lowPrioritySettings so
+	// that log ingestion yields to interactive queries on a busy server.
+	LowPriority bool `json:"low_priority"`
+
+	// Tracing wraps every flush in an OpenTelemetry span recording the
+	// table, the number of rows and whether the flush succeeded, see
+	// traceFlush. Spans go to the global tracer provider, so they are only
+	// exported if the binary includes a plugin that registers one.
+	Tracing bool `json:"tracing"`
+
+	// FlushCycles lets rows accumulate over up to this many flush intervals
+	// before they are inserted, trading latency for fewer, larger inserts
+	// on low traffic writers. A pending batch is still flushed at the next
+	// interval once it holds BatchSize rows, so rows wait at most
+	// FlushCycles*FlushInterval and batches stay near BatchSize under load.
+	// The default of 1 flushes on every interval.
+	FlushCycles int `json:"flush_cycles"`
+	BatchSize   int `json:"batch_size"`
+
+	// FlushAlign schedules flushes on wall clock multiples of FlushInterval,
+	// e.g. on the full minute for a 1m interval, instead of one interval
+	// after the writer was opened. Writers that share an interval then flush
+	// together, in this process and on every host with a synchronized clock,
+	// which turns their inserts into regular bursts. FlushOffset shifts a
+	// writer's ticks by a fixed amount, so that giving writers different
+	// offsets staggers them deliberately instead. RetryJitter cannot be
+	// combined with FlushAlign.
+	FlushAlign  bool           `json:"flush_align"`
+	FlushOffset caddy.Duration `json:"flush_offset"`
+
+	// MinFlushRows holds back interval flushes while fewer rows than this
+	// are buffered, so that a quiet writer does not create a part for every
+	// couple of rows. MaxRowAge, which is required with it, bounds how long
+	// rows are held back: once the oldest buffered row was received that
+	// long ago, the buffer is flushed at the next interval however small it
+	// is. Rows therefore wait at most MaxRowAge plus one flush interval.
+	// Closing the writer and FlushAndWait flush regardless.
+	MinFlushRows int            `json:"min_flush_rows"`
+	MaxRowAge    caddy.Duration `json:"max_row_age"`
+
+	// RetryJitter randomizes the delay before a failed flush is retried to
+	// anywhere between half and one and a half flush intervals, so that a
+	// fleet of writers that failed together does not retry in lockstep.
+	RetryJitter bool `json:"retry_jitter"`
+
+	// MaxBackpressure bounds how far the flush interval is stretched while
+	// ClickHouse rejects inserts with TOO_MANY_PARTS. Every such rejection
+	// doubles the interval, up to MaxBackpressure times FlushInterval, to
+	// give merges time to catch up, and the first successful flush restores
+	// it. It defaults to defaultMaxBackpressure; 1 disables the slowdown.
+	MaxBackpressure int `json:"max_backpressure"`
+
+	// RowsPerSend splits a flush into insert batches of at most this many
+	// rows. FlushPacing pauses between those batches to spread the CPU cost
+	// of serializing and compressing a large flush on small hosts, at the
+	// price of a longer flush. Both are disabled by default.
+	RowsPerSend int            `json:"rows_per_send"`
+	FlushPacing caddy.Duration `json:"flush_pacing"`
+
+	// CaseInsensitiveColumns matches top level log keys to columns ignoring
+	// case when no key has exactly the column's name. See appendRow for how
+	// keys that only differ in case are resolved.
+	CaseInsensitiveColumns bool `json:"case_insensitive_columns"`
+
+	// OnExtraField decides what happens to log lines with a top level field
+	// the table has no column for: "ignore" (the default) leaves the field
+	// out, "error" leaves the whole line out and counts it in the stats as
+	// rejected, and "route_raw" inserts the line as usual but also stores
+	// it verbatim in RawColumn, so that nothing from it is lost. Derived
+	// columns such as the *_column options count as fields too.
+	OnExtraField string `json:"on_extra_field"`
+	RawColumn    string `json:"raw_column"`
+
+	// EmptyStringAsNull inserts empty strings as NULL into Nullable columns
+	// of the table, such as Nullable(String), so that aggregations skip
+	// them. Columns that are not Nullable still receive the empty string.
+	EmptyStringAsNull bool `json:"empty_string_as_null"`
+
+	// MissingColumns decides what a column receives when a log line has no
+	// field for it. With "zero" (the default) the driver inserts NULL into
+	// Nullable columns and the zero value of the type into all others.
+	// "strict" looks up the table's columns when the writer is opened and
+	// inserts NULL into Nullable columns, leaves columns with a DEFAULT out
+	// of the INSERT so that the server computes them, and rejects lines
+	// missing any other column, logging the column and counting the line
+	// in the stats as rejected. In both modes ColumnDefaults, keyed by
+	// column, supplies the value of missing fields first. Strict mode
+	// cannot be used with a table function, and it only sees columns added
+	// to the table after the writer was opened once it is reopened.
+	MissingColumns string         `json:"missing_columns"`
+	ColumnDefaults map[string]any `json:"column_defaults"`
+
+	// SelfTest inserts a row into a throwaway copy of the table when the
+	// writer is opened, failing early if the insert path does not work.
+	// See selfTest for the privileges this needs.
+	SelfTest bool `json:"self_test"`
+
+	// RequestSizeColumn and ResponseSizeColumn name UInt64 columns that
+	// receive the request body size and response size of Caddy's access log,
+	// or zero when the log line has none. Each is read from the first of
+	// RequestSizeFields or ResponseSizeFields present in the line, which
+	// default to the paths used by the different Caddy versions, see
+	// defaultRequestSizeFields.
+	RequestSizeColumn  string   `json:"request_size_column"`
+	RequestSizeFields  []string `json:"request_size_fields"`
+	ResponseSizeColumn string   `json:"response_size_column"`
+	ResponseSizeFields []string `json:"response_size_fields"`
+
+	// ServerNameColumn names a column that records which site produced the
+	// log line, read from ServerNameField (request.host by default). Lines
+	// without that field get ServerName instead. This and the other *Field
+	// options are field paths, which can also index into arrays, see
+	// parsePath.
+	ServerNameColumn string `json:"server_name_column"`
+	ServerNameField  string `json:"server_name_field"`
+	ServerName       string `json:"server_name"`
+
+	// HandlerColumn names a column that records the route or handler that
+	// served the request, read from HandlerField. Caddy does not log this by
+	// default, so the field must be set, typically to a value added with
+	// log_append or a request header. Lines without it get HandlerDefault.
+	HandlerColumn  string `json:"handler_column"`
+	HandlerField   string `json:"handler_field"`
+	HandlerDefault string `json:"handler_default"`
+
+	// StartupDiscardDuration drops, and counts in the stats, every line
+	// written during this long after the writer was opened, e.g. the noise
+	// of a restart. Lines written from then on are buffered as usual, and
+	// the end of the warm-up is logged. It is disabled by default.
+	StartupDiscardDuration caddy.Duration `json:"startup_discard_duration"`
+
+	// DropURIPatterns lists path.Match globs, such as "/healthz" or
+	// "/internal/*", matched against the request URI of Caddy's access log.
+	// Matching lines, typically from health checks, are dropped in Write
+	// and counted in the stats instead of being stored. See droppedURI.
+	DropURIPatterns []string `json:"drop_uri_patterns"`
+
+	// SampleRate keeps only this fraction of the log lines, between 0 and
+	// 1, dropping the others in Write and counting them in the stats. Lines
+	// are picked at random unless SampleKey names a field path, such as a
+	// trace or session ID, whose value decides for all lines that share
+	// it, see sampled. Zero, the default, and 1 keep every line.
+	SampleRate float64 `json:"sample_rate"`
+	SampleKey  string  `json:"sample_key"`
+
+	// HashColumn names a column that receives a hash of each log line, for
+	// deduplication or integrity checks. HashAlgorithm is "xxhash" (the
+	// default, for a UInt64 column) or "sha256" (for a hex String). The
+	// whole line is hashed unless HashFields lists the field paths to hash
+	// instead, see rowHasher.
+	HashColumn    string   `json:"hash_column"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	HashFields    []string `json:"hash_fields"`
+
+	// UserColumn names a column that records the authenticated user of the
+	// request, read from Caddy's user_id field, which authentication
+	// handlers such as basic_auth set. Anonymous requests get UserDefault,
+	// an empty string unless configured.
+	UserColumn  string `json:"user_column"`
+	UserDefault string `json:"user_default"`
+
+	// SequenceColumn names a UInt64 column that receives a number that
+	// increases by one for every row this writer buffers, starting at 1.
+	// It gives a total order of the rows of a single writer, e.g. as a
+	// ReplacingMergeTree version, but it is local to the process and
+	// restarts whenever the writer is reopened, so it is not unique across
+	// writers, hosts or config reloads.
+	SequenceColumn string `json:"sequence_column"`
+
+	// ReceivedAtColumn names a DateTime64 column that receives the time the
+	// writer received the log line, as opposed to when it was flushed, so
+	// that comparing it with the insert time yields the buffering latency.
+	ReceivedAtColumn string `json:"received_at_column"`
+
+	// TLSVersionColumn and TLSCipherColumn name String columns that receive
+	// the TLS version and cipher suite negotiated for the request, such as
+	// "TLS 1.3" and "TLS_AES_128_GCM_SHA256", or an empty string for
+	// plaintext requests.
+	TLSVersionColumn string `json:"tls_version_column"`
+	TLSCipherColumn  string `json:"tls_cipher_column"`
+
+	// DurationSecondsColumn names a Float64 column that receives the
+	// request duration in seconds, read from Caddy's duration field.
+	// DurationNonFinite decides how NaN and infinite durations are stored:
+	// as 0 ("zero", the default) or as NULL ("null", for a
+	// Nullable(Float64) column).
+	DurationSecondsColumn string `json:"duration_seconds_column"`
+	DurationNonFinite     string `json:"duration_non_finite"`
+
+	// CacheStatusColumn names a column that records whether the response
+	// was served from a cache, read from the Cache-Status response header
+	// (see cacheStatus) that caching handlers set. With CacheStatusType
+	// "enum" (the default) it receives "hit", "miss" or, if the header is
+	// missing, "unknown", for a String or Enum column; with "bool" it
+	// receives true for hits only, for a Bool column.
+	CacheStatusColumn string `json:"cache_status_column"`
+	CacheStatusType   string `json:"cache_status_type"`
+
+	// PathColumn and QueryColumn name String columns that receive the path
+	// and the query string (without the "?") of the request URI, so that
+	// requests can be grouped by path without parsing the URI in queries.
+	PathColumn  string `json:"path_column"`
+	QueryColumn string `json:"query_column"`
+
+	// IPFamilyColumn names a column, typically LowCardinality(String), that
+	// receives "v4" or "v6" depending on the client address of the request,
+	// or "unknown" when it is missing or unparseable.
+	IPFamilyColumn string `json:"ip_family_column"`
+
+	// JSONStringColumns maps String columns to field paths whose value is
+	// stored JSON encoded if it is an object or array, e.g. the request
+	// headers, keeping their structure without a JSON or Map column. Other
+	// values are stored as they are, and the column is left unset if the
+	// field is missing. A column may have the name of the field it encodes.
+	JSONStringColumns map[string]string `json:"json_string_columns"`
+
+	// MaxConcurrentWrites bounds how many goroutines may be inside Write at
+	// once; further callers wait on the semaphore rather than all
+	// piling onto the buffer lock. Zero, the default, means no limit.
+	MaxConcurrentWrites int `json:"max_concurrent_writes"`
+
+	// BufferWarnThreshold logs a warning, at most once per
+	// bufferWarnInterval, when Write finds at least this many rows waiting
+	// in the buffer, giving operators notice that flushes are falling
+	// behind. Rows buffered over the threshold are also counted in the
+	// stats. Zero, the default, disables the warning.
+	BufferWarnThreshold int `json:"buffer_warn_threshold"`
+
+	// BufferCompressThreshold stores rows written while at least this many
+	// rows are waiting in the buffer compressed with LZ4, as the raw line,
+	// instead of decoded. Flushes decompress and decode them again, so
+	// during an outage the buffer holds more rows in the same memory at the
+	// cost of CPU, see BenchmarkBufferCompression. Zero, the default, keeps
+	// every row decoded.
+	BufferCompressThreshold int `json:"buffer_compress_threshold"`
+
+	// CircuitFailures enables a circuit breaker that opens after this many
+	// consecutive failed flushes, e.g. during a sustained outage. While it
+	// is open, Write rejects rows instead of buffering them, dropping them
+	// silently by default or failing with an error if CircuitOpenAction is
+	// "error", and the flush loop stops retrying. After
+	// CircuitProbeInterval (30s by default) the server is pinged every
+	// flush interval, and the circuit closes again after
+	// CircuitSuccesses (1 by default) pings in a row succeed. Rows that
+	// were buffered when the circuit opened are kept and flushed once it
+	// closes. See circuitState for the states, which are reported in the
+	// stats table.
+	CircuitFailures      int            `json:"circuit_failures"`
+	CircuitSuccesses     int            `json:"circuit_successes"`
+	CircuitProbeInterval caddy.Duration `json:"circuit_probe_interval"`
+	CircuitOpenAction    string         `json:"circuit_open_action"`
+
+	// DualWriteHost and DualWritePort name a second, independent ClickHouse
+	// server that receives every batch as well, with the same database,
+	// table and credentials, for redundancy across clusters. The port
+	// defaults to Port. With DualWritePolicy "any" (the default), a batch
+	// counts as sent once either server accepted it, so a server that was
+	// down misses those rows for good. With "both", a batch counts as sent
+	// only once both accepted it, and is otherwise retried on both,
+	// duplicating it on the server that had accepted it. Batches are sent
+	// to the servers one after the other, and auto_migrate and self_test
+	// only run against the primary.
+	DualWriteHost   string `json:"dual_write_host"`
+	DualWritePort   string `json:"dual_write_port"`
+	DualWritePolicy string `json:"dual_write_policy"`
+
+	// CloseMode decides what happens to buffered rows when the writer is
+	// closed, e.g. on a config reload: "flush" (the default) sends them
+	// before Close returns, "drop" discards them so that Close only waits
+	// for a flush that is already in flight. "background" returns as
+	// quickly as drop but hands the rows to a background drainer, which
+	// flushes them after Close has returned, retrying until they are sent,
+	// see drainer. During a reload the old and new writers then overlap:
+	// both insert into the table at the same time, the old writer's last
+	// rows may land after the first rows of its replacement, and while the
+	// server is down both hold rows in memory. When the process exits,
+	// Close flushes as in "flush", and the exit waits for each drain still
+	// in progress to make one last attempt, after which rows that could
+	// not be sent are dropped.
+	CloseMode string `json:"close_mode"`
+
+	// ValidateRowShapes checks on every flush whether all buffered rows have
+	// the same set of top level keys, which they normally do unless the
+	// upstream log format changed. "warn" logs and counts flushes with mixed
+	// shapes; "split" additionally sends each shape as its own batch so that
+	// a failure caused by one shape does not hold back the others. It is off
+	// by default because it costs a pass over the keys of every row.
+	ValidateRowShapes string `json:"validate_row_shapes"`
+
+	// PartitionField groups the rows of a flush by the value at this field
+	// path and sends each group as its own batch, so that with a table
+	// partitioned by that value every insert creates a part in only one
+	// partition. With PartitionBy set to "hour", "day" or "month" the
+	// field is parsed as a timestamp (see TimestampLayout) and grouped at
+	// that granularity in UTC instead, to match partition keys such as
+	// toYYYYMMDD(ts). Rows without the field are sent together.
+	PartitionField string `json:"partition_field"`
+	PartitionBy    string `json:"partition_by"`
+
+	// QueryComment is embedded as a SQL comment in every INSERT the writer
+	// issues, so that system.query_log shows which config produced them.
+	// Global placeholders such as {system.hostname} or {env.SITE} are
+	// replaced when the writer is provisioned. Comment delimiters,
+	// parentheses and the VALUES and FORMAT keywords are altered so that
+	// the comment cannot break the statement.
+	QueryComment string `json:"query_comment"`
+
+	// Schema declares the columns the table is expected to have. With
+	// AutoMigrate, columns of the schema that the table lacks are added with
+	// ALTER TABLE ADD COLUMN IF NOT EXISTS when the writer is opened;
+	// existing columns are never dropped or modified.
+	Schema      []schemaColumn `json:"schema"`
+	AutoMigrate bool           `json:"auto_migrate"`
+
+	// TimestampField is the dot separated path of the field that holds the
+	// time of the log entry, "ts" for Caddy's default encoders. The field
+	// may be an epoch number or a string in RFC 3339 or TimestampLayout
+	// format, matching any of Caddy's time_format settings. A top level
+	// timestamp field is converted to a time before it is inserted, so it
+	// can be stored in a DateTime or DateTime64 column of the same name.
+	TimestampField  string `json:"timestamp_field"`
+	TimestampLayout string `json:"timestamp_layout"`
+
+	// MaxRowStaleness drops buffered rows whose timestamp is older than this
+	// before they are flushed, for instance when a long outage left the
+	// buffer full of rows past their retention. Requires TimestampField.
+	MaxRowStaleness caddy.Duration `json:"max_row_staleness"`
+
+	// DateColumn names a Date column that receives the calendar date of the
+	// row's TimestampField in Timezone (an IANA name, UTC by default), for
+	// tables partitioned by date. Rows without a parseable timestamp, or
+	// all rows if TimestampField is not set, get the date they were
+	// received instead.
+	DateColumn string `json:"date_column"`
+	Timezone   string `json:"timezone"`
+
+	// CaddyVersionColumn and ModuleVersionColumn name String columns that
+	// receive the version of Caddy and of this module the binary was built
+	// with, to correlate changes in the logs with upgrades. A version the
+	// build info does not record is stored as "unknown".
+	CaddyVersionColumn  string `json:"caddy_version_column"`
+	ModuleVersionColumn string `json:"module_version_column"`
+
+	queryComment    string
+	location        *time.Location
+	versions        map[string]string
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	paths           fieldPaths
+	logger          *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -41,11 +457,374 @@ func (ClickHouseWriter) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up the module.
 func (writer *ClickHouseWriter) Provision(ctx caddy.Context) error {
+	writer.logger = ctx.Logger()
+	if writer.StatsInterval < 0 {
+		return fmt.Errorf("stats_interval must not be negative")
+	}
+	if writer.StatsTable != "" && writer.StatsInterval == 0 {
+		writer.StatsInterval = caddy.Duration(defaultStatsInterval)
+	}
+	if writer.AtRiskRows < 0 || writer.AtRiskAge < 0 {
+		return fmt.Errorf("at_risk_rows and at_risk_age must not be negative")
+	}
+	if (writer.AtRiskRows > 0 || writer.AtRiskAge > 0) && writer.StatsTable == "" {
+		return fmt.Errorf("at_risk_rows and at_risk_age require stats_table")
+	}
+
+	if writer.FlushCycles < 0 {
+		return fmt.Errorf("flush_cycles must not be negative")
+	}
+	if writer.FlushCycles == 0 {
+		writer.FlushCycles = 1
+	}
+	if writer.BatchSize < 0 {
+		return fmt.Errorf("batch_size must not be negative")
+	}
+	if writer.FlushAlign && writer.RetryJitter {
+		return fmt.Errorf("retry_jitter cannot be combined with flush_align")
+	}
+	if writer.FlushOffset < 0 {
+		return fmt.Errorf("flush_offset must not be negative")
+	}
+	if writer.MinFlushRows < 0 {
+		return fmt.Errorf("min_flush_rows must not be negative")
+	}
+	if writer.MinFlushRows > 0 && writer.MaxRowAge <= 0 {
+		return fmt.Errorf("min_flush_rows requires max_row_age")
+	}
+	if writer.MaxBackpressure < 0 {
+		return fmt.Errorf("max_backpressure must not be negative")
+	}
+	if writer.MaxBackpressure == 0 {
+		writer.MaxBackpressure = defaultMaxBackpressure
+	}
+
+	if writer.MaxConcurrentWrites < 0 {
+		return fmt.Errorf("max_concurrent_writes must not be negative")
+	}
+	if writer.BufferWarnThreshold < 0 {
+		return fmt.Errorf("buffer_warn_threshold must not be negative")
+	}
+	if writer.BufferCompressThreshold < 0 {
+		return fmt.Errorf("buffer_compress_threshold must not be negative")
+	}
+	if writer.ReconnectInterval < 0 {
+		return fmt.Errorf("reconnect_interval must not be negative")
+	}
+	if writer.RowsPerSend < 0 {
+		return fmt.Errorf("rows_per_send must not be negative")
+	}
+
+	if writer.HandlerColumn != "" && writer.HandlerField == "" {
+		return fmt.Errorf("handler_column requires a field")
+	}
+	if writer.ServerNameField == "" {
+		writer.ServerNameField = defaultServerNameField
+	}
+	if len(writer.RequestSizeFields) == 0 {
+		writer.RequestSizeFields = defaultRequestSizeFields
+	}
+	if len(writer.ResponseSizeFields) == 0 {
+		writer.ResponseSizeFields = defaultResponseSizeFields
+	}
+	if err := writer.parseFieldPaths(); err != nil {
+		return err
+	}
+	if writer.StartupDiscardDuration < 0 {
+		return fmt.Errorf("startup_discard_duration must not be negative")
+	}
+	if err := validateURIPatterns(writer.DropURIPatterns); err != nil {
+		return err
+	}
+	if writer.SampleRate < 0 || writer.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	if writer.SampleKey != "" && writer.SampleRate == 0 {
+		return fmt.Errorf("sample_key requires sample_rate")
+	}
+	switch writer.HashAlgorithm {
+	case "":
+		writer.HashAlgorithm = hashXXHash
+	case hashXXHash, hashSHA256:
+	default:
+		return fmt.Errorf("invalid hash_algorithm: %s", writer.HashAlgorithm)
+	}
+
+	if err := writer.validateConnection(); err != nil {
+		return err
+	}
+
+	if err := validateTable(writer.Table); err != nil {
+		return err
+	}
+	if err := validateTable(writer.StatsTable); err != nil {
+		return fmt.Errorf("stats_table: %w", err)
+	}
+	for option, table := range map[string]string{"table": writer.Table, "stats_table": writer.StatsTable} {
+		if database := foreignDatabase(table, writer.DbName); database != "" {
+			// Grants are per database, so the user may be allowed to log in
+			// to db_name but not to insert into the other database.
+			writer.logger.Warn("table is in a different database than the connection, make sure the user may insert into it (self_test checks this at startup)",
+				zap.String("option", option), zap.String("table", table), zap.String("table_database", database))
+		}
+	}
+
+	if writer.AutoMigrate {
+		if len(writer.Schema) == 0 {
+			return fmt.Errorf("auto_migrate requires a schema")
+		}
+		if isTableFunction(writer.Table) {
+			return fmt.Errorf("auto_migrate cannot be used with a table function")
+		}
+	}
+	for _, column := range writer.Schema {
+		if column.Name == "" || column.Type == "" {
+			return fmt.Errorf("schema columns need a name and a type")
+		}
+	}
+
+	if writer.SelfTest && isTableFunction(writer.Table) {
+		return fmt.Errorf("self_test cannot be used with a table function")
+	}
+
+	switch writer.MissingColumns {
+	case "":
+		writer.MissingColumns = missingColumnsZero
+	case missingColumnsZero:
+	case missingColumnsStrict:
+		if isTableFunction(writer.Table) {
+			return fmt.Errorf("missing_columns strict cannot be used with a table function")
+		}
+	default:
+		return fmt.Errorf("invalid missing_columns: %s", writer.MissingColumns)
+	}
+
+	writer.location = time.UTC
+	if writer.Timezone != "" {
+		location, err := time.LoadLocation(writer.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+		writer.location = location
+	}
+
+	writer.versions = writer.versionColumns()
+
+	switch writer.CacheStatusType {
+	case "":
+		writer.CacheStatusType = cacheStatusEnum
+	case cacheStatusEnum, cacheStatusBool:
+	default:
+		return fmt.Errorf("invalid cache_status_type: %s", writer.CacheStatusType)
+	}
+
+	switch writer.DurationNonFinite {
+	case "":
+		writer.DurationNonFinite = nonFiniteZero
+	case nonFiniteZero, nonFiniteNull:
+	default:
+		return fmt.Errorf("invalid duration_non_finite: %s", writer.DurationNonFinite)
+	}
+
+	if writer.MaxRowStaleness > 0 && writer.TimestampField == "" {
+		return fmt.Errorf("max_row_staleness requires timestamp_field")
+	}
+
+	if writer.CircuitFailures < 0 || writer.CircuitSuccesses < 0 {
+		return fmt.Errorf("circuit_failures and circuit_successes must not be negative")
+	}
+	if writer.CircuitSuccesses == 0 {
+		writer.CircuitSuccesses = defaultCircuitSuccesses
+	}
+	if writer.CircuitProbeInterval == 0 {
+		writer.CircuitProbeInterval = caddy.Duration(defaultCircuitProbeInterval)
+	}
+	switch writer.CircuitOpenAction {
+	case "":
+		writer.CircuitOpenAction = circuitActionDrop
+	case circuitActionDrop, circuitActionError:
+	default:
+		return fmt.Errorf("invalid circuit_open_action: %s", writer.CircuitOpenAction)
+	}
+
+	switch writer.DualWritePolicy {
+	case "":
+		writer.DualWritePolicy = dualWriteAny
+	case dualWriteAny, dualWriteBoth:
+	default:
+		return fmt.Errorf("invalid dual_write_policy: %s", writer.DualWritePolicy)
+	}
+	if writer.DualWriteHost != "" && writer.DualWritePort == "" {
+		writer.DualWritePort = writer.Port
+	}
+
+	switch writer.CloseMode {
+	case "":
+		writer.CloseMode = closeModeFlush
+	case closeModeFlush, closeModeDrop, closeModeBackground:
+	default:
+		return fmt.Errorf("invalid close_mode: %s", writer.CloseMode)
+	}
+
+	if writer.QueryComment != "" {
+		repl := caddy.NewReplacer()
+		writer.queryComment = escapeQueryComment(repl.ReplaceAll(writer.QueryComment, ""))
+	}
+
+	switch writer.PartitionBy {
+	case "", partitionByHour, partitionByDay, partitionByMonth:
+	default:
+		return fmt.Errorf("invalid partition_by: %s", writer.PartitionBy)
+	}
+	if writer.PartitionBy != "" && writer.PartitionField == "" {
+		return fmt.Errorf("partition_by requires partition_field")
+	}
+
+	switch writer.ValidateRowShapes {
+	case "", rowShapesWarn, rowShapesSplit:
+	default:
+		return fmt.Errorf("invalid validate_row_shapes: %s", writer.ValidateRowShapes)
+	}
+
+	switch writer.OnExtraField {
+	case "":
+		writer.OnExtraField = extraFieldIgnore
+	case extraFieldIgnore, extraFieldError:
+	case extraFieldRouteRaw:
+		if writer.RawColumn == "" {
+			return fmt.Errorf("on_extra_field route_raw requires raw_column")
+		}
+	default:
+		return fmt.Errorf("invalid on_extra_field: %s", writer.OnExtraField)
+	}
+
+	switch writer.NonObject {
+	case "":
+		writer.NonObject = nonObjectError
+	case nonObjectError, nonObjectSkip:
+	case nonObjectWrap:
+		if writer.NonObjectColumn == "" {
+			return fmt.Errorf("non_object wrap requires non_object_column")
+		}
+	default:
+		return fmt.Errorf("invalid non_object policy: %s", writer.NonObject)
+	}
+
+	return writer.validateColumnTargets()
+}
+
+// validateColumnTargets rejects configurations in which two options store a
+// value in the same column, since only one of them could win and which one
+// depends on the order the mappings are applied in.
+func (writer *ClickHouseWriter) validateColumnTargets() error {
+	type target struct{ option, column string }
+	targets := []target{
+		{"request_size_column", writer.RequestSizeColumn},
+		{"response_size_column", writer.ResponseSizeColumn},
+		{"server_name_column", writer.ServerNameColumn},
+		{"handler_column", writer.HandlerColumn},
+		{"hash_column", writer.HashColumn},
+		{"user_column", writer.UserColumn},
+		{"sequence_column", writer.SequenceColumn},
+		{"received_at_column", writer.ReceivedAtColumn},
+		{"tls_version_column", writer.TLSVersionColumn},
+		{"tls_cipher_column", writer.TLSCipherColumn},
+		{"duration_seconds_column", writer.DurationSecondsColumn},
+		{"cache_status_column", writer.CacheStatusColumn},
+		{"path_column", writer.PathColumn},
+		{"query_column", writer.QueryColumn},
+		{"ip_family_column", writer.IPFamilyColumn},
+		{"date_column", writer.DateColumn},
+		{"caddy_version_column", writer.CaddyVersionColumn},
+		{"module_version_column", writer.ModuleVersionColumn},
+	}
+	if writer.OnExtraField == extraFieldRouteRaw {
+		targets = append(targets, target{"raw_column", writer.RawColumn})
+	}
+	if writer.NonObject == nonObjectWrap {
+		targets = append(targets, target{"non_object_column", writer.NonObjectColumn})
+	}
+	for _, column := range slices.Sorted(maps.Keys(writer.JSONStringColumns)) {
+		targets = append(targets, target{"json_string_columns", column})
+	}
+
+	options := map[string]string{}
+	for _, target := range targets {
+		if target.column == "" {
+			continue
+		}
+		if option, ok := options[target.column]; ok {
+			return fmt.Errorf("column %q is set by both %s and %s", target.column, option, target.option)
+		}
+		options[target.column] = target.option
+	}
+	return nil
+}
+
+// fieldPaths holds the field path options, parsed by parseFieldPaths.
+type fieldPaths struct {
+	timestamp    fieldPath
+	serverName   fieldPath
+	handler      fieldPath
+	partition    fieldPath
+	sampleKey    fieldPath
+	requestSize  []fieldPath
+	responseSize []fieldPath
+	hash         []fieldPath
+	jsonStrings  map[string]fieldPath
+}
+
+// parseFieldPaths parses the field paths the writer reads, see parsePath,
+// so that they are not parsed again for every log line.
+func (writer *ClickHouseWriter) parseFieldPaths() error {
+	var err error
+	paths := &writer.paths
+	if writer.TimestampField != "" {
+		if paths.timestamp, err = parsePath(writer.TimestampField); err != nil {
+			return fmt.Errorf("timestamp_field: %w", err)
+		}
+	}
+	if paths.serverName, err = parsePath(writer.ServerNameField); err != nil {
+		return fmt.Errorf("server_name_field: %w", err)
+	}
+	if writer.HandlerField != "" {
+		if paths.handler, err = parsePath(writer.HandlerField); err != nil {
+			return fmt.Errorf("handler_field: %w", err)
+		}
+	}
+	if writer.PartitionField != "" {
+		if paths.partition, err = parsePath(writer.PartitionField); err != nil {
+			return fmt.Errorf("partition_field: %w", err)
+		}
+	}
+	if writer.SampleKey != "" {
+		if paths.sampleKey, err = parsePath(writer.SampleKey); err != nil {
+			return fmt.Errorf("sample_key: %w", err)
+		}
+	}
+	if paths.requestSize, err = parsePaths(writer.RequestSizeFields); err != nil {
+		return fmt.Errorf("request_size_fields: %w", err)
+	}
+	if paths.responseSize, err = parsePaths(writer.ResponseSizeFields); err != nil {
+		return fmt.Errorf("response_size_fields: %w", err)
+	}
+	if paths.hash, err = parsePaths(writer.HashFields); err != nil {
+		return fmt.Errorf("hash_fields: %w", err)
+	}
+	paths.jsonStrings = make(map[string]fieldPath, len(writer.JSONStringColumns))
+	for column, field := range writer.JSONStringColumns {
+		if paths.jsonStrings[column], err = parsePath(field); err != nil {
+			return fmt.Errorf("json_string_columns %s: %w", column, err)
+		}
+	}
 	return nil
 }
 
 // WriterKey returns a unique key representing this nw.
 func (writer *ClickHouseWriter) WriterKey() string {
+	if writer.Key != "" {
+		return writer.Key
+	}
 	return fmt.Sprintf("%s:%s/%s.%s", writer.Host, writer.Port, writer.DbName, writer.Table)
 }
 
@@ -55,29 +834,166 @@ func (writer *ClickHouseWriter) String() string {
 
 // OpenWriter opens a new network connection.
 func (writer *ClickHouseWriter) OpenWriter() (io.WriteCloser, error) {
-	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: []string{fmt.Sprintf("%s:%s", writer.Host, writer.Port)},
-		Auth: clickhouse.Auth{
-			Database: writer.DbName,
-			Username: writer.Username,
-			Password: writer.Password,
+	options := writer.clickhouseOptions()
+	clickhouseConn := clickhouseConn{
+		key:             writer.WriterKey(),
+		username:        writer.Username,
+		table:           writer.Table,
+		buffer:          []bufferedRow{},
+		bufferMu:        sync.Mutex{},
+		flushSem:        make(chan struct{}, 1),
+		flushInterval:   time.Duration(writer.FlushInterval),
+		flushCycles:     writer.FlushCycles,
+		flushAlign:      writer.FlushAlign,
+		flushOffset:     time.Duration(writer.FlushOffset),
+		minFlushRows:    writer.MinFlushRows,
+		maxRowAge:       time.Duration(writer.MaxRowAge),
+		retryJitter:     writer.RetryJitter,
+		maxBackpressure: writer.MaxBackpressure,
+		batchSize:       writer.BatchSize,
+		rowsPerSend:     writer.RowsPerSend,
+		flushPacing:     time.Duration(writer.FlushPacing),
+		caseInsensitive: writer.CaseInsensitiveColumns,
+		emptyAsNull:     writer.EmptyStringAsNull,
+		strictColumns:   writer.MissingColumns == missingColumnsStrict,
+		extraFields:     writer.OnExtraField,
+		rawColumn:       writer.RawColumn,
+		statsTable:      writer.StatsTable,
+		statsInterval:   time.Duration(writer.StatsInterval),
+		atRiskRows:      writer.AtRiskRows,
+		atRiskAge:       time.Duration(writer.AtRiskAge),
+		nonObject:       writer.NonObject,
+		nonObjectCol:    writer.NonObjectColumn,
+		verifyInserts:   writer.VerifyInserts,
+		lowPriority:     writer.LowPriority,
+		tracing:         writer.Tracing,
+		options:         options,
+		reconnectEvery:  time.Duration(writer.ReconnectInterval),
+		maxRowStaleness: time.Duration(writer.MaxRowStaleness),
+		sequenceColumn:  writer.SequenceColumn,
+		bufferWarnAt:    writer.BufferWarnThreshold,
+		compressAt:      writer.BufferCompressThreshold,
+		dropURIs:        writer.DropURIPatterns,
+		sampleRate:      writer.SampleRate,
+		sampleKey:       writer.paths.sampleKey,
+		closeMode:       writer.CloseMode,
+		rowShapes:       writer.ValidateRowShapes,
+		partitionField:  writer.paths.partition,
+		partitionBy:     writer.PartitionBy,
+		queryComment:    writer.queryComment,
+		logger:          writer.logger,
+		done:            make(chan struct{}),
+		wg:              sync.WaitGroup{},
+		hasher: rowHasher{
+			column:    writer.HashColumn,
+			algorithm: writer.HashAlgorithm,
+			fields:    writer.HashFields,
+			paths:     writer.paths.hash,
+		},
+		circuit: circuitBreaker{
+			failureThreshold: writer.CircuitFailures,
+			successThreshold: writer.CircuitSuccesses,
+			probeInterval:    time.Duration(writer.CircuitProbeInterval),
+			dropRows:         writer.CircuitOpenAction == circuitActionDrop,
+		},
+		columns: columnMapping{
+			requestSize: sizeColumn{
+				column: writer.RequestSizeColumn,
+				fields: writer.paths.requestSize,
+			},
+			responseSize: sizeColumn{
+				column: writer.ResponseSizeColumn,
+				fields: writer.paths.responseSize,
+			},
+			timestampField:  writer.TimestampField,
+			timestampPath:   writer.paths.timestamp,
+			timestampLayout: writer.TimestampLayout,
+			date:            writer.DateColumn,
+			location:        writer.location,
+			receivedAt:      writer.ReceivedAtColumn,
+			tlsVersion:      writer.TLSVersionColumn,
+			tlsCipher:       writer.TLSCipherColumn,
+			ipFamily:        writer.IPFamilyColumn,
+			path:            writer.PathColumn,
+			query:           writer.QueryColumn,
+			durationSeconds: writer.DurationSecondsColumn,
+			durationNull:    writer.DurationNonFinite == nonFiniteNull,
+			cacheStatus:     writer.CacheStatusColumn,
+			cacheStatusBool: writer.CacheStatusType == cacheStatusBool,
+			jsonStrings:     writer.paths.jsonStrings,
+			constants:       writer.versions,
+			defaults:        writer.ColumnDefaults,
+			caseInsensitive: writer.CaseInsensitiveColumns,
+			serverName: stringColumn{
+				column:   writer.ServerNameColumn,
+				field:    writer.paths.serverName,
+				fallback: writer.ServerName,
+			},
+			handler: stringColumn{
+				column:   writer.HandlerColumn,
+				field:    writer.paths.handler,
+				fallback: writer.HandlerDefault,
+			},
+			user: stringColumn{
+				column:   writer.UserColumn,
+				field:    userIDField,
+				fallback: writer.UserDefault,
+			},
 		},
-		TLS: &tls.Config{},
-	})
+	}
+	if writer.StartupDiscardDuration > 0 {
+		clickhouseConn.warmupUntil = time.Now().Add(time.Duration(writer.StartupDiscardDuration))
+	}
+	if writer.MaxConcurrentWrites > 0 {
+		clickhouseConn.writeSem = make(chan struct{}, writer.MaxConcurrentWrites)
+	}
+	conn, err := clickhouseConn.open(options)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", err)
+		return nil, err
 	}
-
-	clickhouseConn := clickhouseConn{
-		Conn:          conn,
-		table:         writer.Table,
-		buffer:        []any{},
-		bufferMu:      sync.Mutex{},
-		flushInterval: time.Duration(writer.FlushInterval),
-		done:          make(chan struct{}),
-		wg:            sync.WaitGroup{},
+	clickhouseConn.Conn = conn
+	if writer.DualWriteHost != "" {
+		secondaryOptions := writer.dualWriteOptions()
+		secondary, err := clickhouseConn.open(secondaryOptions)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("dual_write server: %w", err)
+		}
+		clickhouseConn.secondary = secondary
+		clickhouseConn.secondaryOpts = secondaryOptions
+		clickhouseConn.bothRequired = writer.DualWritePolicy == dualWriteBoth
+	}
+	if writer.AutoMigrate {
+		if err := clickhouseConn.migrate(writer.Schema); err != nil {
+			clickhouseConn.closeConns()
+			return nil, fmt.Errorf("auto migration failed: %w", err)
+		}
 	}
+	if clickhouseConn.strictColumns {
+		columns, err := clickhouseConn.introspectColumns()
+		if err != nil {
+			clickhouseConn.closeConns()
+			return nil, fmt.Errorf("missing_columns strict: %w", err)
+		}
+		clickhouseConn.insertColumns = columns
+	}
+	if writer.SelfTest {
+		if err := clickhouseConn.selfTest(); err != nil {
+			clickhouseConn.closeConns()
+			return nil, fmt.Errorf("self test failed: %w", err)
+		}
+	}
+
+	clickhouseConn.wg.Add(1)
 	go clickhouseConn.flushLoop()
+	if clickhouseConn.statsTable != "" {
+		clickhouseConn.wg.Add(1)
+		go clickhouseConn.statsLoop()
+	}
+	if clickhouseConn.reconnectEvery > 0 {
+		clickhouseConn.wg.Add(1)
+		go clickhouseConn.reconnectLoop()
+	}
 
 	return &clickhouseConn, nil
 }
@@ -90,8 +1006,80 @@ func (writer *ClickHouseWriter) OpenWriter() (io.WriteCloser, error) {
 //	    host <string>
 //	    password <string>
 //	    port <string>
-//	    tls <string>
+//	    tls [<bool>]
+//	    tls_min_version <1.0|1.1|1.2|1.3>
+//	    tls_cipher_suites <name...>
+//	    reconnect_interval <duration>
 //	    flush_interval <duration>
+//	    protocol <native|http>
+//	    compression <none|lz4|lz4hc|zstd|gzip|deflate|br>
+//	    flush_cycles <int>
+//	    flush_align [<bool>]
+//	    flush_offset <duration>
+//	    min_flush_rows <int>
+//	    max_row_age <duration>
+//	    retry_jitter [<bool>]
+//	    max_backpressure <int>
+//	    batch_size <int>
+//	    rows_per_send <int>
+//	    flush_pacing <duration>
+//	    stats_table <string>
+//	    stats_interval <duration>
+//	    at_risk_rows <int>
+//	    at_risk_age <duration>
+//	    non_object <error|skip|wrap> [<column>]
+//	    verify_inserts [<bool>]
+//	    writer_key <string>
+//	    low_priority [<bool>]
+//	    tracing [<bool>]
+//	    request_size_column <column> [<field...>]
+//	    response_size_column <column> [<field...>]
+//	    server_name_column <column> [<field>]
+//	    server_name <string>
+//	    handler_column <column> <field> [<default>]
+//	    startup_discard_duration <duration>
+//	    drop_uri_patterns <pattern...>
+//	    sample_rate <float>
+//	    sample_key <field>
+//	    hash_column <column> [<xxhash|sha256>]
+//	    hash_fields <field...>
+//	    user_column <column> [<default>]
+//	    sequence_column <column>
+//	    received_at_column <column>
+//	    tls_version_column <column>
+//	    tls_cipher_column <column>
+//	    duration_seconds_column <column> [<zero|null>]
+//	    cache_status_column <column> [<enum|bool>]
+//	    path_column <column>
+//	    query_column <column>
+//	    ip_family_column <column>
+//	    json_string_column <column> [<field>]
+//	    max_concurrent_writes <int>
+//	    buffer_warn_threshold <int>
+//	    buffer_compress_threshold <int>
+//	    dual_write <host> [<port>] [<any|both>]
+//	    circuit_failures <int>
+//	    circuit_successes <int>
+//	    circuit_probe_interval <duration>
+//	    circuit_open_action <drop|error>
+//	    close_mode <flush|drop|background>
+//	    validate_row_shapes <warn|split>
+//	    partition_field <field> [<hour|day|month>]
+//	    query_comment <string>
+//	    schema {
+//	        <column> <type>
+//	    }
+//	    auto_migrate [<bool>]
+//	    timestamp_field <field> [<layout>]
+//	    max_row_staleness <duration>
+//	    date_column <column> [<timezone>]
+//	    version_columns <caddy_column> [<module_column>]
+//	    case_insensitive_columns [<bool>]
+//	    on_extra_field <ignore|error|route_raw> [<raw_column>]
+//	    empty_string_as_null [<bool>]
+//	    missing_columns <zero|strict>
+//	    column_default <column> <value>
+//	    self_test [<bool>]
 //	}
 func (nw *ClickHouseWriter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -128,9 +1116,42 @@ func (nw *ClickHouseWriter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 
 			case "tls":
-				if !d.Args(&nw.TLS) {
+				nw.TLS = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.TLS = tlsSetting(enabled)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "tls_min_version":
+				if !d.Args(&nw.TLSMinVersion) {
+					return d.ArgErr()
+				}
+
+			case "tls_cipher_suites":
+				suites := d.RemainingArgs()
+				if len(suites) == 0 {
 					return d.ArgErr()
 				}
+				nw.TLSCipherSuites = append(nw.TLSCipherSuites, suites...)
+
+			case "reconnect_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				reconnectInterval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.ReconnectInterval = caddy.Duration(reconnectInterval)
 
 			case "flush_interval":
 				if !d.NextArg() {
@@ -145,86 +1166,1426 @@ func (nw *ClickHouseWriter) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				nw.FlushInterval = caddy.Duration(flushInterval)
 
-			default:
-				return d.Errf("unrecognized subdirective '%s'", d.Val())
-			}
-		}
-	}
-	return nil
-}
+			case "protocol":
+				if !d.Args(&nw.Protocol) {
+					return d.ArgErr()
+				}
 
-// clickhouseConn wraps a ClickHouse connection and implements the io.WriteCloser interface.
-type clickhouseConn struct {
-	driver.Conn
-	table         string
-	buffer        []any
-	bufferMu      sync.Mutex
-	flushInterval time.Duration
-	done          chan struct{}
-	wg            sync.WaitGroup
-}
+			case "compression":
+				if !d.Args(&nw.Compression) {
+					return d.ArgErr()
+				}
 
-func (conn *clickhouseConn) flush() error {
-	conn.bufferMu.Lock()
-	defer conn.bufferMu.Unlock()
+			case "flush_cycles":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				flushCycles, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.FlushCycles = flushCycles
 
-	if len(conn.buffer) == 0 {
-		return nil
-	}
+			case "flush_align":
+				nw.FlushAlign = true
+				if d.NextArg() {
+					flushAlign, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.FlushAlign = flushAlign
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 
-	ctx := context.Background()
-	batch, err := conn.Conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s", conn.table))
-	if err != nil {
-		return fmt.Errorf("failed to prepare batch: %w", err)
-	}
-	defer batch.Close()
+			case "flush_offset":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				flushOffset, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.FlushOffset = caddy.Duration(flushOffset)
 
-	for _, data := range conn.buffer {
-		if err := batch.AppendStruct(data); err != nil {
-			return fmt.Errorf("failed to append struct: %w", err)
-		}
-	}
+			case "min_flush_rows":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				minFlushRows, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.MinFlushRows = minFlushRows
 
-	if err := batch.Send(); err != nil {
-		return fmt.Errorf("failed to send batch: %w", err)
+			case "max_row_age":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxRowAge, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.MaxRowAge = caddy.Duration(maxRowAge)
+
+			case "retry_jitter":
+				nw.RetryJitter = true
+				if d.NextArg() {
+					retryJitter, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.RetryJitter = retryJitter
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_backpressure":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxBackpressure, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.MaxBackpressure = maxBackpressure
+
+			case "batch_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				batchSize, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.BatchSize = batchSize
+
+			case "rows_per_send":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rowsPerSend, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.RowsPerSend = rowsPerSend
+
+			case "flush_pacing":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				flushPacing, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.FlushPacing = caddy.Duration(flushPacing)
+
+			case "stats_table":
+				if !d.Args(&nw.StatsTable) {
+					return d.ArgErr()
+				}
+
+			case "stats_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				statsInterval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.StatsInterval = caddy.Duration(statsInterval)
+
+			case "at_risk_rows":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				atRiskRows, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.AtRiskRows = atRiskRows
+
+			case "at_risk_age":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				atRiskAge, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.AtRiskAge = caddy.Duration(atRiskAge)
+
+			case "non_object":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.NonObject = d.Val()
+				if d.NextArg() {
+					nw.NonObjectColumn = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "verify_inserts":
+				nw.VerifyInserts = true
+				if d.NextArg() {
+					verifyInserts, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.VerifyInserts = verifyInserts
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "low_priority":
+				nw.LowPriority = true
+				if d.NextArg() {
+					lowPriority, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.LowPriority = lowPriority
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "tracing":
+				nw.Tracing = true
+				if d.NextArg() {
+					tracing, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.Tracing = tracing
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "request_size_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.RequestSizeColumn = d.Val()
+				nw.RequestSizeFields = d.RemainingArgs()
+
+			case "response_size_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.ResponseSizeColumn = d.Val()
+				nw.ResponseSizeFields = d.RemainingArgs()
+
+			case "server_name_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.ServerNameColumn = d.Val()
+				if d.NextArg() {
+					nw.ServerNameField = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "server_name":
+				if !d.Args(&nw.ServerName) {
+					return d.ArgErr()
+				}
+
+			case "handler_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.HandlerColumn = d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.HandlerField = d.Val()
+				if d.NextArg() {
+					nw.HandlerDefault = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "startup_discard_duration":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				startupDiscardDuration, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.StartupDiscardDuration = caddy.Duration(startupDiscardDuration)
+
+			case "sample_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				sampleRate, err := strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("invalid number: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.SampleRate = sampleRate
+
+			case "sample_key":
+				if !d.Args(&nw.SampleKey) {
+					return d.ArgErr()
+				}
+
+			case "drop_uri_patterns":
+				patterns := d.RemainingArgs()
+				if len(patterns) == 0 {
+					return d.ArgErr()
+				}
+				nw.DropURIPatterns = append(nw.DropURIPatterns, patterns...)
+
+			case "hash_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.HashColumn = d.Val()
+				if d.NextArg() {
+					nw.HashAlgorithm = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "hash_fields":
+				fields := d.RemainingArgs()
+				if len(fields) == 0 {
+					return d.ArgErr()
+				}
+				nw.HashFields = append(nw.HashFields, fields...)
+
+			case "user_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.UserColumn = d.Val()
+				if d.NextArg() {
+					nw.UserDefault = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "sequence_column":
+				if !d.Args(&nw.SequenceColumn) {
+					return d.ArgErr()
+				}
+
+			case "received_at_column":
+				if !d.Args(&nw.ReceivedAtColumn) {
+					return d.ArgErr()
+				}
+
+			case "tls_version_column":
+				if !d.Args(&nw.TLSVersionColumn) {
+					return d.ArgErr()
+				}
+
+			case "tls_cipher_column":
+				if !d.Args(&nw.TLSCipherColumn) {
+					return d.ArgErr()
+				}
+
+			case "duration_seconds_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.DurationSecondsColumn = d.Val()
+				if d.NextArg() {
+					nw.DurationNonFinite = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "cache_status_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.CacheStatusColumn = d.Val()
+				if d.NextArg() {
+					nw.CacheStatusType = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "path_column":
+				if !d.Args(&nw.PathColumn) {
+					return d.ArgErr()
+				}
+
+			case "query_column":
+				if !d.Args(&nw.QueryColumn) {
+					return d.ArgErr()
+				}
+
+			case "ip_family_column":
+				if !d.Args(&nw.IPFamilyColumn) {
+					return d.ArgErr()
+				}
+
+			case "json_string_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				column, field := d.Val(), d.Val()
+				if d.NextArg() {
+					field = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if nw.JSONStringColumns == nil {
+					nw.JSONStringColumns = make(map[string]string)
+				}
+				nw.JSONStringColumns[column] = field
+
+			case "max_concurrent_writes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxConcurrentWrites, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.MaxConcurrentWrites = maxConcurrentWrites
+
+			case "buffer_warn_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				bufferWarnThreshold, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.BufferWarnThreshold = bufferWarnThreshold
+
+			case "buffer_compress_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				bufferCompressThreshold, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.BufferCompressThreshold = bufferCompressThreshold
+
+			case "dual_write":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.DualWriteHost = d.Val()
+				for d.NextArg() {
+					switch d.Val() {
+					case dualWriteAny, dualWriteBoth:
+						nw.DualWritePolicy = d.Val()
+					default:
+						if nw.DualWritePort != "" || nw.DualWritePolicy != "" {
+							return d.ArgErr()
+						}
+						nw.DualWritePort = d.Val()
+					}
+				}
+
+			case "circuit_failures":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				circuitFailures, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.CircuitFailures = circuitFailures
+
+			case "circuit_successes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				circuitSuccesses, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid integer: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.CircuitSuccesses = circuitSuccesses
+
+			case "circuit_probe_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				circuitProbeInterval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.CircuitProbeInterval = caddy.Duration(circuitProbeInterval)
+
+			case "circuit_open_action":
+				if !d.Args(&nw.CircuitOpenAction) {
+					return d.ArgErr()
+				}
+
+			case "close_mode":
+				if !d.Args(&nw.CloseMode) {
+					return d.ArgErr()
+				}
+
+			case "partition_field":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.PartitionField = d.Val()
+				if d.NextArg() {
+					nw.PartitionBy = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "validate_row_shapes":
+				if !d.Args(&nw.ValidateRowShapes) {
+					return d.ArgErr()
+				}
+
+			case "query_comment":
+				if !d.Args(&nw.QueryComment) {
+					return d.ArgErr()
+				}
+
+			case "schema":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for schemaNesting := d.Nesting(); d.NextBlock(schemaNesting); {
+					column := schemaColumn{Name: d.Val()}
+					args := d.RemainingArgs()
+					if len(args) == 0 {
+						return d.ArgErr()
+					}
+					column.Type = strings.Join(args, " ")
+					nw.Schema = append(nw.Schema, column)
+				}
+
+			case "auto_migrate":
+				nw.AutoMigrate = true
+				if d.NextArg() {
+					autoMigrate, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.AutoMigrate = autoMigrate
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "timestamp_field":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.TimestampField = d.Val()
+				if d.NextArg() {
+					nw.TimestampLayout = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "date_column":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.DateColumn = d.Val()
+				if d.NextArg() {
+					nw.Timezone = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "version_columns":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.CaddyVersionColumn = d.Val()
+				if d.NextArg() {
+					nw.ModuleVersionColumn = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_row_staleness":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxRowStaleness, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %s", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.MaxRowStaleness = caddy.Duration(maxRowStaleness)
+
+			case "case_insensitive_columns":
+				nw.CaseInsensitiveColumns = true
+				if d.NextArg() {
+					caseInsensitive, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.CaseInsensitiveColumns = caseInsensitive
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "on_extra_field":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				nw.OnExtraField = d.Val()
+				if d.NextArg() {
+					nw.RawColumn = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "empty_string_as_null":
+				nw.EmptyStringAsNull = true
+				if d.NextArg() {
+					emptyStringAsNull, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.EmptyStringAsNull = emptyStringAsNull
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "missing_columns":
+				if !d.Args(&nw.MissingColumns) {
+					return d.ArgErr()
+				}
+
+			case "column_default":
+				var column, value string
+				if !d.Args(&column, &value) {
+					return d.ArgErr()
+				}
+				if nw.ColumnDefaults == nil {
+					nw.ColumnDefaults = make(map[string]any)
+				}
+				// Values are decoded like log lines, so that 0 or true
+				// match the type of the field they stand in for; anything
+				// that is not JSON is taken as a string.
+				var decoded any
+				if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+					decoded = value
+				}
+				nw.ColumnDefaults[column] = decoded
+
+			case "self_test":
+				nw.SelfTest = true
+				if d.NextArg() {
+					selfTest, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Errf("invalid boolean: %s", d.Val())
+					}
+					nw.SelfTest = selfTest
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "writer_key":
+				if !d.Args(&nw.Key) {
+					return d.ArgErr()
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Values of the close_mode option.
+const (
+	closeModeFlush      = "flush"
+	closeModeDrop       = "drop"
+	closeModeBackground = "background"
+)
+
+// errWriterClosed is returned by Write, Flush and FlushAndWait once Close has
+// been called.
+var errWriterClosed = errors.New("clickhouse writer is closed")
+
+// clickhouseConn wraps a ClickHouse connection and implements the io.WriteCloser interface.
+type clickhouseConn struct {
+	driver.Conn
+	key             string
+	username        string
+	table           string
+	buffer          []bufferedRow
+	bufferMu        sync.Mutex
+	flushSem        chan struct{}
+	flushInterval   time.Duration
+	flushCycles     int
+	flushAlign      bool
+	flushOffset     time.Duration
+	minFlushRows    int
+	maxRowAge       time.Duration
+	retryJitter     bool
+	maxBackpressure int
+	batchSize       int
+	rowsPerSend     int
+	flushPacing     time.Duration
+	memoryLimit     int
+	memorySends     int
+	caseInsensitive bool
+	emptyAsNull     bool
+	strictColumns   bool
+	insertColumns   []tableColumn
+	extraFields     string
+	rawColumn       string
+	stats           flushStats
+	statsTable      string
+	statsInterval   time.Duration
+	atRiskRows      int
+	atRiskAge       time.Duration
+	inFlight        int
+	inFlightSince   time.Time
+	nonObject       string
+	nonObjectCol    string
+	verifyInserts   bool
+	lowPriority     bool
+	tracing         bool
+	columns         columnMapping
+	maxRowStaleness time.Duration
+	sequenceColumn  string
+	sequence        atomic.Uint64
+	writeSem        chan struct{}
+	bufferWarnAt    int
+	compressAt      int
+	packer          rowPacker
+	warmupUntil     time.Time
+	dropURIs        []string
+	sampleRate      float64
+	sampleKey       fieldPath
+	hasher          rowHasher
+	lastBufferWarn  time.Time
+	closeMode       string
+	secondary       driver.Conn
+	bothRequired    bool
+	connMu          sync.RWMutex
+	options         *clickhouse.Options
+	secondaryOpts   *clickhouse.Options
+	reconnectEvery  time.Duration
+	circuit         circuitBreaker
+	rowShapes       string
+	partitionField  fieldPath
+	partitionBy     string
+	queryComment    string
+	logger          *zap.Logger
+	closed          bool
+	finalFlushErr   error
+	done            chan struct{}
+	wg              sync.WaitGroup
+}
+
+// flush sends the buffered rows to ClickHouse. The rows are taken out of the
+// buffer while they are sent so that Write is never blocked on the network,
+// and any rows that could not be sent are put back in front of the buffer.
+// flushSem serializes concurrent flushes, and connMu keeps reconnect from
+// closing the connection the rows are being sent on. If ctx is done while
+// waiting for a flush in progress, flush returns ctx's error.
+func (conn *clickhouseConn) flush(ctx context.Context) error {
+	select {
+	case conn.flushSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-conn.flushSem }()
+	conn.connMu.RLock()
+	defer conn.connMu.RUnlock()
+
+	conn.bufferMu.Lock()
+	rows := conn.buffer
+	conn.buffer = []bufferedRow{}
+	conn.updatePacking()
+	conn.inFlight = len(rows)
+	if len(rows) > 0 {
+		conn.inFlightSince = rows[0].receivedAt
+	}
+	conn.bufferMu.Unlock()
+
+	// Compressed rows are decoded and stale rows dropped outside the lock,
+	// so that Write is not held up by a large buffer either.
+	rows = conn.unpackRows(rows)
+	var stale int
+	if conn.maxRowStaleness > 0 {
+		rows, stale = conn.dropStale(rows)
+	}
+	if len(rows) == 0 {
+		conn.bufferMu.Lock()
+		conn.inFlight = 0
+		conn.stats.staleRowsDropped += uint64(stale)
+		conn.bufferMu.Unlock()
+		return nil
+	}
+
+	var groups []int
+	shapes := 1
+	if conn.rowShapes != "" {
+		grouped, ends := groupRows(rows, rowShape)
+		if shapes = len(ends); shapes > 1 {
+			conn.logger.Warn("buffered rows have different shapes",
+				zap.String("writer", conn.key),
+				zap.Int("rows", len(rows)),
+				zap.Int("shapes", shapes),
+			)
+			if conn.rowShapes == rowShapesSplit {
+				rows, groups = grouped, ends
+			}
+		}
+	}
+	if conn.partitionField != nil || conn.strictColumns {
+		rows, groups = groupRows(rows, conn.groupKey(groups != nil))
+	}
+
+	var before uint64
+	if conn.verifyInserts {
+		var err error
+		if before, err = conn.countRows(ctx); err != nil {
+			conn.logger.Warn("failed to count rows before flush", zap.String("writer", conn.key), zap.Error(err))
+		}
+	}
+
+	sendCtx, endSpan := conn.traceFlush(ctx, len(rows))
+	start := time.Now()
+	sent, rejected, err := conn.sendChunks(sendCtx, rows, groups)
+	duration := time.Since(start)
+	endSpan(sent, rejected, err)
+
+	landed := true
+	if conn.verifyInserts && sent > rejected {
+		landed = conn.verifyInsert(ctx, before, sent-rejected)
 	}
 
-	conn.buffer = []any{}
+	conn.bufferMu.Lock()
+	defer conn.bufferMu.Unlock()
+
+	conn.inFlight = 0
+	conn.stats.staleRowsDropped += uint64(stale)
+	conn.stats.lastFlushDuration = duration
+	conn.stats.rowsFlushed += uint64(sent - rejected)
+	conn.stats.rowsRejected += uint64(rejected)
+	if !landed {
+		conn.stats.insertDiscrepancies++
+	}
+	if shapes > 1 {
+		conn.stats.rowShapeMismatches++
+	}
+	if err != nil {
+		conn.stats.flushErrors++
+		if column := errorColumn(err); column != "" {
+			if conn.stats.columnErrors == nil {
+				conn.stats.columnErrors = make(map[string]uint64)
+			}
+			conn.stats.columnErrors[column]++
+		}
+		conn.buffer = append(repackRows(rows[sent:]), conn.buffer...)
+		conn.updatePacking()
+		return err
+	}
 	return nil
 }
 
+// sendChunks sends rows in batches of at most rowsPerSend rows, pausing for
+// flushPacing between batches, and returns how many rows were sent before
+// the first failure, along with how many of those were rejected by
+// on_extra_field error or missing_columns strict instead of inserted. If groups holds the end offsets
+// of groups of rows, no batch spans more than one group.
+//
+// When the server rejects a batch with MEMORY_LIMIT_EXCEEDED, the batch is
+// retried at half its size, and later batches are capped at that size too.
+// The cap is doubled again after every memoryRecoverySends successful sends
+// until it reaches rowsPerSend, which lifts it, or without bound if
+// rows_per_send is not set. A single row that exceeds the limit fails
+// the flush as usual.
+func (conn *clickhouseConn) sendChunks(ctx context.Context, rows []bufferedRow, groups []int) (sent, rejected int, err error) {
+	if groups == nil {
+		groups = []int{len(rows)}
+	}
+
+	for _, groupEnd := range groups {
+		for sent < groupEnd {
+			if sent > 0 && conn.flushPacing > 0 {
+				select {
+				case <-ctx.Done():
+					return sent, rejected, ctx.Err()
+				case <-time.After(conn.flushPacing):
+				}
+			}
+			end := groupEnd
+			if limit := conn.sendLimit(); limit > 0 {
+				end = min(sent+limit, groupEnd)
+			}
+			chunkRejected, err := conn.send(ctx, rows[sent:end])
+			if err != nil && isMemoryLimitExceeded(err) && end-sent > 1 {
+				conn.memoryLimit = (end - sent) / 2
+				conn.memorySends = 0
+				conn.logger.Warn("server ran out of memory for insert, halving rows per send",
+					zap.String("writer", conn.key), zap.Int("rows_per_send", conn.memoryLimit), zap.Error(err))
+				continue
+			}
+			if err != nil {
+				return sent, rejected, err
+			}
+			sent = end
+			rejected += chunkRejected
+			conn.recoverMemoryLimit()
+		}
+	}
+	return sent, rejected, nil
+}
+
+// memoryRecoverySends is the number of successful sends after which a batch
+// size cap imposed by MEMORY_LIMIT_EXCEEDED is doubled.
+const memoryRecoverySends = 10
+
+// sendLimit returns the maximum number of rows per batch, or zero for no
+// limit. It must be called while holding flushSem.
+func (conn *clickhouseConn) sendLimit() int {
+	if conn.memoryLimit > 0 {
+		return conn.memoryLimit
+	}
+	return conn.rowsPerSend
+}
+
+// recoverMemoryLimit records a successful send and relaxes the batch size cap
+// imposed by MEMORY_LIMIT_EXCEEDED once enough sends have succeeded. It must
+// be called while holding flushSem.
+func (conn *clickhouseConn) recoverMemoryLimit() {
+	if conn.memoryLimit == 0 {
+		return
+	}
+	if conn.memorySends++; conn.memorySends < memoryRecoverySends {
+		return
+	}
+	conn.memorySends = 0
+	conn.memoryLimit *= 2
+	if conn.rowsPerSend > 0 && conn.memoryLimit >= conn.rowsPerSend {
+		conn.memoryLimit = 0
+		conn.logger.Info("restored rows per send after memory pressure", zap.String("writer", conn.key))
+	}
+}
+
+// lowPrioritySettings are applied to every query when low_priority is set.
+// A non-zero priority makes the server pause these queries while queries
+// with a lower (more important) value run, and os_thread_priority lowers the
+// nice value of the threads executing them (this requires CAP_SYS_NICE on
+// the server and is otherwise ignored).
+var lowPrioritySettings = clickhouse.Settings{
+	"priority":           10,
+	"os_thread_priority": 19,
+}
+
+// queryContext returns the context that the writer's queries are issued with,
+// derived from ctx.
+func (conn *clickhouseConn) queryContext(ctx context.Context) context.Context {
+	if conn.lowPriority {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(lowPrioritySettings))
+	}
+	return ctx
+}
+
+// send inserts rows into the destination table as a single batch, and
+// returns how many rows it left out because of on_extra_field error or
+// missing_columns strict. With dual_write the batch is then sent to the
+// secondary server as well.
+func (conn *clickhouseConn) send(ctx context.Context, rows []bufferedRow) (int, error) {
+	rejected, err := conn.sendTo(ctx, conn.Conn, rows)
+	if conn.secondary == nil {
+		return rejected, err
+	}
+	_, secondaryErr := conn.sendTo(ctx, conn.secondary, rows)
+	return rejected, conn.dualWriteResult(err, secondaryErr)
+}
+
+// sendTo inserts rows into the destination table on target.
+func (conn *clickhouseConn) sendTo(ctx context.Context, target driver.Conn, rows []bufferedRow) (int, error) {
+	ctx = conn.queryContext(ctx)
+	query := insertQuery(conn.table, conn.queryComment)
+	if conn.strictColumns && len(rows) > 0 {
+		// Rows are grouped by omittedKey, so all rows leave out the same
+		// columns as the first.
+		if omitted, _ := conn.missingColumns(conn.columns.apply(rows[0])); len(omitted) > 0 {
+			query = conn.omittingQuery(omitted)
+		}
+	}
+	batch, err := target.PrepareBatch(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare batch: %w", wrapAuthError(err, conn.username))
+	}
+	defer batch.Close()
+
+	var nullable []bool
+	if conn.emptyAsNull {
+		nullable = nullableColumns(batch)
+	}
+	var columns map[string]bool
+	if conn.extraFields != extraFieldIgnore {
+		columns = columnNames(batch, conn.caseInsensitive)
+	}
+
+	rejected := 0
+	var rejectedField, unfilledColumn string
+	for _, row := range rows {
+		fields := conn.columns.apply(row)
+		if conn.strictColumns {
+			if _, column := conn.missingColumns(fields); column != "" {
+				rejected++
+				unfilledColumn = column
+				continue
+			}
+		}
+		if columns != nil {
+			if field := extraField(fields, columns, conn.caseInsensitive); field != "" {
+				if conn.extraFields == extraFieldError {
+					rejected++
+					rejectedField = field
+					continue
+				}
+				fields[conn.rawColumn] = string(row.raw)
+			}
+		}
+		if err := appendRow(batch, fields, conn.caseInsensitive, nullable); err != nil {
+			return 0, fmt.Errorf("failed to append row: %w", err)
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		return 0, fmt.Errorf("failed to send batch: %w", err)
+	}
+	if rejected > 0 && target == conn.Conn {
+		if rejectedField != "" {
+			conn.logger.Warn("rejected rows with fields the table has no column for",
+				zap.String("writer", conn.key), zap.Int("rows", rejected), zap.String("field", rejectedField))
+		}
+		if unfilledColumn != "" {
+			conn.logger.Warn("rejected rows without a field for a column that is neither Nullable nor has a DEFAULT",
+				zap.String("writer", conn.key), zap.Int("rows", rejected), zap.String("column", unfilledColumn))
+		}
+	}
+	return rejected, nil
+}
+
+// countRows returns the number of rows currently in the destination table.
+func (conn *clickhouseConn) countRows(ctx context.Context) (uint64, error) {
+	var count uint64
+	row := conn.Conn.QueryRow(conn.queryContext(ctx), fmt.Sprintf("SELECT count() FROM %s", conn.table))
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// verifyInsert compares the growth of the destination table since before
+// against the number of rows sent and reports whether all of them landed.
+func (conn *clickhouseConn) verifyInsert(ctx context.Context, before uint64, sent int) bool {
+	after, err := conn.countRows(ctx)
+	if err != nil {
+		conn.logger.Warn("failed to count rows after flush", zap.String("writer", conn.key), zap.Error(err))
+		return true
+	}
+	if after < before+uint64(sent) {
+		conn.logger.Warn("fewer rows landed than were sent",
+			zap.String("writer", conn.key),
+			zap.Int("sent", sent),
+			zap.Uint64("before", before),
+			zap.Uint64("after", after),
+		)
+		return false
+	}
+	return true
+}
+
+// batchReady reports whether the buffer should be flushed after it has been
+// pending for the given number of flush intervals. With min_flush_rows, a
+// smaller buffer is held back until its oldest row reaches max_row_age.
+func (conn *clickhouseConn) batchReady(cycles int) bool {
+	conn.bufferMu.Lock()
+	defer conn.bufferMu.Unlock()
+
+	if len(conn.buffer) < conn.minFlushRows {
+		return len(conn.buffer) > 0 && time.Since(conn.buffer[0].receivedAt) >= conn.maxRowAge
+	}
+	if cycles >= conn.flushCycles {
+		return true
+	}
+	return conn.batchSize > 0 && len(conn.buffer) >= conn.batchSize
+}
+
+// tickDelay returns how long to wait for the next flush interval of the given
+// length. Normally that is the interval itself; with flush_align it is the
+// time until the next multiple of interval since the Unix epoch, shifted by
+// flush_offset.
+func (conn *clickhouseConn) tickDelay(interval time.Duration) time.Duration {
+	if !conn.flushAlign || interval <= 0 {
+		return interval
+	}
+	now := time.Now().UnixNano()
+	offset := int64(conn.flushOffset) % int64(interval)
+	next := (now-offset)/int64(interval)*int64(interval) + offset + int64(interval)
+	return time.Duration(next - now)
+}
+
+// defaultMaxBackpressure is the default of max_backpressure.
+const defaultMaxBackpressure = 16
+
+// retryDelay returns how long to wait before retrying a failed flush, given
+// the current interval. With retry_jitter the interval is scaled by a random
+// factor in [0.5, 1.5), which keeps the average retry rate while spreading
+// retries out.
+func (conn *clickhouseConn) retryDelay(interval time.Duration) time.Duration {
+	if !conn.retryJitter || interval <= 0 {
+		return conn.tickDelay(interval)
+	}
+	return interval/2 + rand.N(interval)
+}
+
 func (conn *clickhouseConn) flushLoop() {
-	conn.wg.Add(1)
 	defer conn.wg.Done()
 
+	cycles := 0
+	delay := conn.tickDelay(conn.flushInterval)
+	// backpressure is the multiple of the flush interval flushes currently
+	// wait, raised while the server reports too many parts.
+	backpressure := 1
 	for {
 		select {
 		case <-conn.done:
+			// Write stops accepting rows before done is closed, so this
+			// drains everything that was ever buffered.
+			if conn.closeMode == closeModeFlush {
+				conn.finalFlushErr = conn.flush(context.Background())
+			}
 			return
-		case <-time.After(conn.flushInterval):
-			conn.flush()
+		case <-time.After(delay):
+			delay = conn.tickDelay(conn.flushInterval * time.Duration(backpressure))
+			if !conn.circuitAllowsFlush() {
+				continue
+			}
+			if cycles++; !conn.batchReady(cycles) {
+				continue
+			}
+			cycles = 0
+			err := conn.flush(context.Background())
+			conn.recordCircuit(err)
+			if err == nil {
+				if backpressure > 1 {
+					conn.logger.Info("inserts accepted again, restoring flush interval", zap.String("writer", conn.key))
+				}
+				backpressure = 1
+				delay = conn.tickDelay(conn.flushInterval)
+				continue
+			}
+			conn.logger.Error("flush failed", zap.String("writer", conn.key), zap.Error(err))
+			if isTooManyParts(err) && backpressure < conn.maxBackpressure {
+				backpressure = min(backpressure*2, conn.maxBackpressure)
+				conn.logger.Warn("server has too many parts, slowing down flushes",
+					zap.String("writer", conn.key), zap.Duration("flush_interval", conn.flushInterval*time.Duration(backpressure)))
+			}
+			delay = conn.retryDelay(conn.flushInterval * time.Duration(backpressure))
 		}
 	}
 }
 
 func (conn *clickhouseConn) Write(b []byte) (n int, err error) {
+	if conn.writeSem != nil {
+		conn.writeSem <- struct{}{}
+		defer func() { <-conn.writeSem }()
+	}
+
+	// Decode before taking the buffer lock so that concurrent writers only
+	// contend on the append itself.
+	fields, err := conn.decodeLine(b)
+	if err != nil {
+		return 0, err
+	}
+	if fields == nil {
+		return len(b), nil
+	}
+	receivedAt := time.Now()
+	dropped := len(conn.dropURIs) > 0 && droppedURI(fields, conn.dropURIs)
+	sampledOut := !conn.sampled(fields)
+	conn.hasher.apply(b, fields)
+	var packed *packedRow
+	if conn.compressAt > 0 && conn.packer.over.Load() {
+		packed = conn.packer.pack(b, fields, conn.hasher.column)
+	}
+
 	conn.bufferMu.Lock()
-	defer conn.bufferMu.Unlock()
+	if conn.closed {
+		conn.bufferMu.Unlock()
+		return 0, errWriterClosed
+	}
+	if !conn.warmupUntil.IsZero() {
+		if receivedAt.Before(conn.warmupUntil) {
+			conn.stats.warmupDropped++
+			conn.bufferMu.Unlock()
+			return len(b), nil
+		}
+		conn.warmupUntil = time.Time{}
+		conn.logger.Info("startup warm-up ended, buffering log lines",
+			zap.String("writer", conn.key), zap.Uint64("dropped", conn.stats.warmupDropped))
+	}
+	if dropped {
+		conn.stats.rowsFiltered++
+		conn.bufferMu.Unlock()
+		return len(b), nil
+	}
+	if sampledOut {
+		conn.stats.rowsSampledOut++
+		conn.bufferMu.Unlock()
+		return len(b), nil
+	}
+	if !conn.circuit.accepting() {
+		conn.circuit.rejected++
+		conn.bufferMu.Unlock()
+		if conn.circuit.dropRows {
+			return len(b), nil
+		}
+		return 0, errCircuitOpen
+	}
+	if conn.sequenceColumn != "" {
+		sequence := conn.sequence.Add(1)
+		fields[conn.sequenceColumn] = sequence
+		if packed != nil {
+			packed.sequence = sequence
+		}
+	}
+	row := bufferedRow{fields: fields, receivedAt: receivedAt}
+	if packed != nil {
+		row = bufferedRow{receivedAt: receivedAt, packed: packed}
+	} else if conn.extraFields == extraFieldRouteRaw {
+		// Write must not retain b.
+		row.raw = bytes.Clone(b)
+	}
+	conn.buffer = append(conn.buffer, row)
+	conn.updatePacking()
+	depth := len(conn.buffer)
+	warn := conn.overBufferThreshold(receivedAt)
+	conn.bufferMu.Unlock()
+
+	if warn {
+		conn.logger.Warn("buffered rows exceed buffer_warn_threshold, flushes are falling behind",
+			zap.String("writer", conn.key), zap.Int("rows", depth), zap.Int("threshold", conn.bufferWarnAt))
+	}
+	return len(b), nil
+}
 
+// decodeLine decodes a log line into the fields of a row. A line that is
+// not a JSON object is handled as non_object says; it decodes to nil fields
+// without an error if it is to be skipped.
+func (conn *clickhouseConn) decodeLine(b []byte) (map[string]any, error) {
 	var data any
 	if err := json.Unmarshal(b, &data); err != nil {
-		return 0, fmt.Errorf("failed to unmarshal data (clickhouse writer only accepts `format json`): %w", err)
+		return nil, fmt.Errorf("failed to unmarshal data (clickhouse writer only accepts `format json`): %w", err)
+	}
+	fields, ok := data.(map[string]any)
+	if !ok {
+		switch conn.nonObject {
+		case nonObjectSkip:
+			return nil, nil
+		case nonObjectWrap:
+			fields = map[string]any{conn.nonObjectCol: data}
+		default:
+			return nil, fmt.Errorf("log line is not a JSON object: %s", b)
+		}
 	}
-	conn.buffer = append(conn.buffer, data)
+	return fields, nil
+}
 
-	return len(b), nil
+// bufferWarnInterval is the minimum time between two buffer_warn_threshold
+// warnings of the same connection.
+const bufferWarnInterval = time.Minute
+
+// overBufferThreshold counts the row just buffered if the buffer is at or
+// over buffer_warn_threshold, and reports whether a warning is due. It must
+// be called with bufferMu held.
+func (conn *clickhouseConn) overBufferThreshold(now time.Time) bool {
+	if conn.bufferWarnAt == 0 || len(conn.buffer) < conn.bufferWarnAt {
+		return false
+	}
+	conn.stats.rowsOverThreshold++
+	if now.Sub(conn.lastBufferWarn) < bufferWarnInterval {
+		return false
+	}
+	conn.lastBufferWarn = now
+	return true
+}
+
+// FlushAndWait sends the buffered rows now instead of at the next flush
+// interval and returns once they are sent, or with the context's error if
+// ctx is done first. In that case the flush carries on in the background. It
+// gives tests and low volume flows a point at which everything written so
+// far has reached ClickHouse, without waiting out the flush interval.
+func (conn *clickhouseConn) FlushAndWait(ctx context.Context) error {
+	if err := conn.startFlush(); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer conn.wg.Done()
+		result <- conn.flush(context.Background())
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush sends the buffered rows now, issuing the inserts with ctx so that
+// cancelling it aborts the flush. Rows that were not sent by then stay
+// buffered for the next flush, as after any failed flush. Flush is safe to
+// call concurrently with Write and with the background flush loop; flushes
+// never overlap, so Flush first waits for one in progress to finish, or
+// returns ctx's error without flushing if ctx is done first. Unlike
+// FlushAndWait, Flush does not return before the flush has stopped.
+func (conn *clickhouseConn) Flush(ctx context.Context) error {
+	if err := conn.startFlush(); err != nil {
+		return err
+	}
+	defer conn.wg.Done()
+	return conn.flush(ctx)
+}
+
+// startFlush registers a flush requested through Flush or FlushAndWait with
+// wg, or returns errWriterClosed. Registering while closed is false under
+// bufferMu guarantees that Close waits for the flush before closing the
+// connection.
+func (conn *clickhouseConn) startFlush() error {
+	conn.bufferMu.Lock()
+	defer conn.bufferMu.Unlock()
+
+	if conn.closed {
+		return errWriterClosed
+	}
+	conn.wg.Add(1)
+	return nil
 }
 
+// Close stops accepting writes and waits for the flush loop to send what is
+// left in the buffer, or to discard it in close_mode drop, before closing
+// the connection. In close_mode background the buffer and connection are
+// handed to the background drainer instead, unless the process is exiting.
 func (conn *clickhouseConn) Close() error {
+	conn.bufferMu.Lock()
+	conn.closed = true
+	conn.bufferMu.Unlock()
+
 	close(conn.done)
 	conn.wg.Wait()
-	if err := conn.flush(); err != nil {
-		return fmt.Errorf("failed to flush buffer: %w", err)
+	if conn.closeMode == closeModeDrop {
+		conn.bufferMu.Lock()
+		if dropped := len(conn.buffer); dropped > 0 {
+			conn.logger.Warn("dropping buffered rows on close", zap.String("writer", conn.key), zap.Int("rows", dropped))
+		}
+		conn.buffer = nil
+		conn.bufferMu.Unlock()
+	}
+	if conn.closeMode == closeModeBackground {
+		if !caddy.Exiting() {
+			backgroundDrainer.submit(conn)
+			return nil
+		}
+		// The process would exit before the drainer is done, so the rows
+		// are flushed before Close returns as in close_mode flush.
+		conn.finalFlushErr = conn.flush(context.Background())
+	}
+	// The connection is closed even if the final flush failed, as nothing
+	// can use it anymore.
+	var err error
+	if conn.finalFlushErr != nil {
+		err = fmt.Errorf("failed to flush buffer: %w", conn.finalFlushErr)
 	}
-	return conn.Conn.Close()
+	return errors.Join(err, conn.closeConns())
 }
@@ -0,0 +1,463 @@
+package chwriter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// startTestConn starts the flush loop of conn, as OpenWriter does.
+func startTestConn(conn *clickhouseConn) *clickhouseConn {
+	conn.flushInterval = time.Hour
+	conn.wg.Add(1)
+	go conn.flushLoop()
+	return conn
+}
+
+// writeUntilClosed writes distinct lines to conn from several goroutines
+// until Write reports that the writer is closed, closing started once the
+// first line is accepted. The returned function waits for the goroutines
+// and returns how many lines were accepted.
+func writeUntilClosed(t *testing.T, conn *clickhouseConn, started chan<- struct{}) func() int64 {
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	var once sync.Once
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				_, err := conn.Write(fmt.Appendf(nil, `{"uri":"/%d/%d"}`, w, i))
+				if errors.Is(err, errWriterClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Write: %v", err)
+					return
+				}
+				accepted.Add(1)
+				once.Do(func() { close(started) })
+			}
+		}()
+	}
+	return func() int64 {
+		wg.Wait()
+		return accepted.Load()
+	}
+}
+
+// Every line Write accepts while the writer is closing is sent by the final
+// flush, and lines written after that are refused.
+func TestCloseFlushesConcurrentWrites(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := startTestConn(newTestConn(fake))
+
+	started := make(chan struct{})
+	wait := writeUntilClosed(t, conn, started)
+	<-started
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	accepted := wait()
+
+	if n := len(conn.buffer); n != 0 {
+		t.Errorf("%d rows left in the buffer after Close", n)
+	}
+	sent := map[any]bool{}
+	for _, row := range fake.rows() {
+		if sent[row[0]] {
+			t.Errorf("row %v sent twice", row[0])
+		}
+		sent[row[0]] = true
+	}
+	if int64(len(sent)) != accepted {
+		t.Errorf("sent %d rows, want the %d accepted by Write", len(sent), accepted)
+	}
+	if !fake.isClosed() {
+		t.Error("connection not closed")
+	}
+	if _, err := conn.Write([]byte(`{"uri":"/late"}`)); !errors.Is(err, errWriterClosed) {
+		t.Errorf("Write after Close: %v, want errWriterClosed", err)
+	}
+}
+
+// A failed final flush is reported by Close, which still closes the
+// connection.
+func TestCloseClosesConnAfterFailedFlush(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := startTestConn(newTestConn(fake))
+	fake.failSends(errors.New("server unavailable"))
+
+	started := make(chan struct{})
+	wait := writeUntilClosed(t, conn, started)
+	<-started
+	err := conn.Close()
+	wait()
+
+	if err == nil {
+		t.Fatal("Close succeeded, want the final flush error")
+	}
+	if !fake.isClosed() {
+		t.Error("connection left open after the final flush failed")
+	}
+}
+
+// Flush gives up waiting for a flush in progress once ctx is done, leaving
+// the rows buffered.
+func TestFlushHonorsContextWhileWaiting(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := newTestConn(fake)
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.flushSem <- struct{}{} // a flush in progress
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := conn.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Flush: %v, want context.DeadlineExceeded", err)
+	}
+	if n := len(conn.buffer); n != 1 {
+		t.Errorf("%d rows buffered, want 1", n)
+	}
+
+	<-conn.flushSem
+	if err := conn.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if n := len(fake.rows()); n != 1 {
+		t.Errorf("sent %d rows, want 1", n)
+	}
+}
+
+// benchLine is a typical access log line of about 700 bytes.
+var benchLine = []byte(`{"level":"info","ts":1714564800.123,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"203.0.113.7","remote_port":"51234","client_ip":"203.0.113.7","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/static/app.js?v=42","headers":{"User-Agent":["Mozilla/5.0 (X11; Linux x86_64)"],"Accept":["*/*"],"Accept-Encoding":["gzip, br"]},"tls":{"resumed":false,"version":772,"cipher_suite":4865,"proto":"h2","server_name":"example.com"}},"bytes_read":0,"user_id":"","duration":0.000912,"size":5123,"status":200,"resp_headers":{"Content-Type":["application/javascript"],"Cache-Control":["max-age=3600"]}}` + "\n")
+
+// BenchmarkWriteParallel measures Write from eight goroutines per CPU,
+// which decode their lines before taking the buffer lock. With
+// max_concurrent_writes bounding Write to one goroutine per CPU, the extra
+// writers queue on the semaphore instead of on the buffer lock.
+func BenchmarkWriteParallel(b *testing.B) {
+	for _, bench := range []struct {
+		name      string
+		maxWrites int
+	}{
+		{"unbounded", 0},
+		{"max_concurrent_writes", runtime.GOMAXPROCS(0)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn := newTestConn(newFakeConn())
+			if bench.maxWrites > 0 {
+				conn.writeSem = make(chan struct{}, bench.maxWrites)
+			}
+			b.SetBytes(int64(len(benchLine)))
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := conn.Write(benchLine); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkWriteParallelDecodeUnderLock is the baseline for
+// BenchmarkWriteParallel: the same work with the line decoded while holding
+// the buffer lock, as Write did before, so that writers contend on the
+// decoding too.
+func BenchmarkWriteParallelDecodeUnderLock(b *testing.B) {
+	conn := newTestConn(newFakeConn())
+	b.SetBytes(int64(len(benchLine)))
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn.bufferMu.Lock()
+			var fields map[string]any
+			if err := json.Unmarshal(benchLine, &fields); err != nil {
+				b.Error(err)
+			}
+			conn.buffer = append(conn.buffer, bufferedRow{fields: fields, receivedAt: time.Now()})
+			conn.bufferMu.Unlock()
+		}
+	})
+}
+
+func TestWriteNonObject(t *testing.T) {
+	lines := []string{`[1,2]`, `"text"`, `42`, `null`}
+	for _, mode := range []string{nonObjectError, nonObjectSkip, nonObjectWrap} {
+		for _, line := range lines {
+			conn := newTestConn(newFakeConn())
+			conn.nonObject = mode
+			conn.nonObjectCol = "value"
+
+			n, err := conn.Write([]byte(line))
+			switch mode {
+			case nonObjectError:
+				if err == nil {
+					t.Errorf("%s %s: Write succeeded, want an error", mode, line)
+				}
+			case nonObjectSkip:
+				if err != nil || n != len(line) || len(conn.buffer) != 0 {
+					t.Errorf("%s %s: Write = %d, %v with %d rows, want the line skipped", mode, line, n, err, len(conn.buffer))
+				}
+			case nonObjectWrap:
+				if err != nil || len(conn.buffer) != 1 {
+					t.Fatalf("%s %s: Write = %d, %v with %d rows, want one row", mode, line, n, err, len(conn.buffer))
+				}
+				if got, _ := json.Marshal(conn.buffer[0].fields["value"]); string(got) != line {
+					t.Errorf("%s %s: value = %s, want %s", mode, line, got, line)
+				}
+			}
+		}
+	}
+
+	conn := newTestConn(newFakeConn())
+	conn.nonObject = nonObjectSkip
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil || len(conn.buffer) != 1 {
+		t.Errorf("object line: err = %v with %d rows, want it buffered", err, len(conn.buffer))
+	}
+}
+
+// Sequence numbers are assigned under the buffer lock, so they increase
+// along the buffer without gaps or duplicates however many goroutines
+// write, and a row keeps its number when a failed flush puts it back.
+func TestSequenceColumnMonotonic(t *testing.T) {
+	fake := newFakeConn("seq UInt64")
+	conn := newTestConn(fake)
+	conn.sequenceColumn = "seq"
+
+	const writers, lines = 8, 200
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range lines {
+				if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	fake.failSends(errors.New("server unavailable"))
+	if err := conn.flush(context.Background()); err == nil {
+		t.Fatal("flush succeeded, want the injected error")
+	}
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := fake.rows()
+	if len(rows) != writers*lines+1 {
+		t.Fatalf("sent %d rows, want %d", len(rows), writers*lines+1)
+	}
+	for i, row := range rows {
+		if row[0] != uint64(i+1) {
+			t.Fatalf("row %d: seq = %v, want %d", i, row[0], i+1)
+		}
+	}
+}
+
+// provisionTest provisions writer outside of a Caddy config, with the table
+// defaulting to logs.
+func provisionTest(writer *ClickHouseWriter) error {
+	if writer.Table == "" {
+		writer.Table = "logs"
+	}
+	return writer.Provision(caddy.Context{})
+}
+
+func TestProvisionStatsInterval(t *testing.T) {
+	err := provisionTest(&ClickHouseWriter{StatsTable: "stats", StatsInterval: caddy.Duration(-time.Second)})
+	if err == nil || !strings.Contains(err.Error(), "stats_interval") {
+		t.Errorf("negative stats_interval: err = %v, want an error naming stats_interval", err)
+	}
+	writer := &ClickHouseWriter{StatsTable: "stats"}
+	if err := provisionTest(writer); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(writer.StatsInterval) != defaultStatsInterval {
+		t.Errorf("stats_interval = %v, want the default %v", time.Duration(writer.StatsInterval), defaultStatsInterval)
+	}
+}
+
+func TestProvisionHandlerColumn(t *testing.T) {
+	if err := provisionTest(&ClickHouseWriter{HandlerColumn: "handler"}); err == nil {
+		t.Error("handler_column without handler_field provisioned, want an error")
+	}
+	writer := &ClickHouseWriter{HandlerColumn: "handler", HandlerField: "route[0]"}
+	if err := provisionTest(writer); err != nil {
+		t.Errorf("Provision: %v", err)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	conn := newTestConn(newFakeConn())
+	const interval = 10 * time.Second
+	if got := conn.retryDelay(interval); got != interval {
+		t.Errorf("without retry_jitter: %v, want %v", got, interval)
+	}
+
+	conn.retryJitter = true
+	low, high := interval, time.Duration(0)
+	for range 10000 {
+		delay := conn.retryDelay(interval)
+		if delay < interval/2 || delay >= interval*3/2 {
+			t.Fatalf("delay %v outside [%v, %v)", delay, interval/2, interval*3/2)
+		}
+		low, high = min(low, delay), max(high, delay)
+	}
+	// The delays spread over the whole range rather than clustering.
+	if low > interval*6/10 || high < interval*14/10 {
+		t.Errorf("delays span [%v, %v], want most of [%v, %v)", low, high, interval/2, interval*3/2)
+	}
+	if got := conn.retryDelay(0); got != 0 {
+		t.Errorf("zero interval: %v, want 0", got)
+	}
+}
+
+func TestProvisionSizeFields(t *testing.T) {
+	writer := &ClickHouseWriter{}
+	if err := provisionTest(writer); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(writer.RequestSizeFields, defaultRequestSizeFields) ||
+		!slices.Equal(writer.ResponseSizeFields, defaultResponseSizeFields) {
+		t.Errorf("size fields = %v and %v, want the defaults", writer.RequestSizeFields, writer.ResponseSizeFields)
+	}
+
+	writer = &ClickHouseWriter{ResponseSizeFields: []string{"upstream.bytes"}}
+	if err := provisionTest(writer); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(writer.ResponseSizeFields, []string{"upstream.bytes"}) {
+		t.Errorf("response_size_fields = %v, want the configured field", writer.ResponseSizeFields)
+	}
+
+	if err := provisionTest(&ClickHouseWriter{RequestSizeFields: []string{"a[x]"}}); err == nil {
+		t.Error("invalid request_size_fields provisioned, want an error")
+	}
+}
+
+func TestStartupDiscard(t *testing.T) {
+	conn := newTestConn(newFakeConn())
+	conn.warmupUntil = time.Now().Add(time.Hour)
+	for range 3 {
+		if n, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil || n == 0 {
+			t.Fatalf("Write during warm-up = %d, %v, want the line accepted", n, err)
+		}
+	}
+	if len(conn.buffer) != 0 || conn.stats.warmupDropped != 3 {
+		t.Errorf("during warm-up: %d rows buffered and %d dropped, want 0 and 3", len(conn.buffer), conn.stats.warmupDropped)
+	}
+
+	conn.warmupUntil = time.Now().Add(-time.Millisecond)
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.buffer) != 1 || !conn.warmupUntil.IsZero() {
+		t.Errorf("after warm-up: %d rows buffered, warm-up until %v, want 1 and cleared", len(conn.buffer), conn.warmupUntil)
+	}
+
+	conn = newTestConn(newFakeConn())
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil || len(conn.buffer) != 1 {
+		t.Errorf("without startup_discard_duration: err = %v with %d rows, want the line buffered", err, len(conn.buffer))
+	}
+}
+
+func TestValidateColumnTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		writer  ClickHouseWriter
+		options []string
+	}{
+		{"distinct", ClickHouseWriter{RequestSizeColumn: "bytes_in", ResponseSizeColumn: "bytes_out", UserColumn: "user"}, nil},
+		{"two columns", ClickHouseWriter{RequestSizeColumn: "bytes", ResponseSizeColumn: "bytes"},
+			[]string{"request_size_column", "response_size_column"}},
+		{"json string column", ClickHouseWriter{HashColumn: "extra", JSONStringColumns: map[string]string{"extra": "request.headers"}},
+			[]string{"hash_column", "json_string_columns"}},
+		{"raw column", ClickHouseWriter{OnExtraField: extraFieldRouteRaw, RawColumn: "path", PathColumn: "path"},
+			[]string{"path_column", "raw_column"}},
+		{"raw column unused", ClickHouseWriter{OnExtraField: extraFieldIgnore, RawColumn: "path", PathColumn: "path"}, nil},
+		{"non-object column", ClickHouseWriter{NonObject: nonObjectWrap, NonObjectColumn: "date", DateColumn: "date"},
+			[]string{"date_column", "non_object_column"}},
+	}
+	for _, tt := range tests {
+		err := tt.writer.validateColumnTargets()
+		if tt.options == nil {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: accepted, want a conflict between %v", tt.name, tt.options)
+			continue
+		}
+		for _, option := range tt.options {
+			if !strings.Contains(err.Error(), option) {
+				t.Errorf("%s: %v, want it to name %s", tt.name, err, option)
+			}
+		}
+	}
+}
+
+// Boolean directives take an optional <bool>, defaulting to true without one.
+func TestUnmarshalCaddyfileBooleans(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    bool
+		wantErr bool
+	}{
+		{"verify_inserts", true, false},
+		{"verify_inserts true", true, false},
+		{"verify_inserts false", false, false},
+		{"verify_inserts maybe", false, true},
+		{"verify_inserts true false", false, true},
+	}
+	for _, tt := range tests {
+		for _, directive := range []string{"verify_inserts", "low_priority", "self_test"} {
+			input := strings.Replace(tt.input, "verify_inserts", directive, 1)
+			var writer ClickHouseWriter
+			err := writer.UnmarshalCaddyfile(caddyfile.NewTestDispenser("clickhouse {\n" + input + "\n}"))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("%q: parsed, want an error", input)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q: %v", input, err)
+				continue
+			}
+			got := map[string]bool{
+				"verify_inserts": writer.VerifyInserts,
+				"low_priority":   writer.LowPriority,
+				"self_test":      writer.SelfTest,
+			}[directive]
+			if got != tt.want {
+				t.Errorf("%q: %s = %t, want %t", input, directive, got, tt.want)
+			}
+		}
+	}
+}
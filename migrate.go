@@ -0,0 +1,84 @@
+package chwriter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// schemaColumn is a column of the declared schema.
+type schemaColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// tableColumns returns the names of the columns the destination table has.
+func (conn *clickhouseConn) tableColumns() (map[string]bool, error) {
+	query, args := systemColumnsQuery(conn.table, "name")
+	rows, err := conn.Conn.Query(conn.queryContext(context.Background()), query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", conn.table, wrapAuthError(err, conn.username))
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", conn.table, err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", conn.table, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", conn.table)
+	}
+	return columns, nil
+}
+
+// systemColumnsQuery returns a query selecting fields from the rows of
+// system.columns that describe table, along with its arguments. Unqualified
+// tables are looked up in the database of the connection.
+func systemColumnsQuery(table, fields string) (string, []any) {
+	database, name := splitTable(table)
+	if database == "" {
+		return fmt.Sprintf("SELECT %s FROM system.columns WHERE database = currentDatabase() AND table = ?", fields), []any{name}
+	}
+	return fmt.Sprintf("SELECT %s FROM system.columns WHERE database = ? AND table = ?", fields), []any{database, name}
+}
+
+// migrate adds the columns of schema that the destination table is missing.
+// It only ever adds columns: existing columns are neither dropped nor
+// altered, even if their type differs from the declared one.
+func (conn *clickhouseConn) migrate(schema []schemaColumn) error {
+	existing, err := conn.tableColumns()
+	if err != nil {
+		return err
+	}
+
+	for _, column := range schema {
+		if existing[column.Name] {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", conn.table, quoteIdentifier(column.Name), column.Type)
+		if err := conn.Conn.Exec(conn.queryContext(context.Background()), query); err != nil {
+			return fmt.Errorf("failed to add column %s to %s: %w", column.Name, conn.table, err)
+		}
+		conn.logger.Info("added missing column",
+			zap.String("writer", conn.key),
+			zap.String("table", conn.table),
+			zap.String("column", column.Name),
+			zap.String("type", column.Type),
+		)
+	}
+	return nil
+}
+
+// quoteIdentifier quotes name with backticks for use in a query.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
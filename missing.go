@@ -0,0 +1,117 @@
+package chwriter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Values of the missing_columns option.
+const (
+	missingColumnsZero   = "zero"
+	missingColumnsStrict = "strict"
+)
+
+// tableColumn is an insertable column of the destination table, as
+// introspected from system.columns for missing_columns strict.
+type tableColumn struct {
+	name       string
+	nullable   bool
+	hasDefault bool
+}
+
+// introspectColumns returns the columns of the destination table that an
+// INSERT can set, in table order. MATERIALIZED and ALIAS columns are always
+// computed by the server and are left out; DEFAULT and EPHEMERAL columns
+// have an expression the server falls back to when they are left out of
+// the INSERT.
+func (conn *clickhouseConn) introspectColumns() ([]tableColumn, error) {
+	query, args := systemColumnsQuery(conn.table, "name, type, default_kind")
+	rows, err := conn.Conn.Query(conn.queryContext(context.Background()), query+" ORDER BY position", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list columns of %s: %w", conn.table, wrapAuthError(err, conn.username))
+	}
+	defer rows.Close()
+
+	var columns []tableColumn
+	for rows.Next() {
+		var name, typ, defaultKind string
+		if err := rows.Scan(&name, &typ, &defaultKind); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", conn.table, err)
+		}
+		switch defaultKind {
+		case "MATERIALIZED", "ALIAS":
+			continue
+		}
+		columns = append(columns, tableColumn{
+			name:       name,
+			nullable:   isNullableType(typ),
+			hasDefault: defaultKind != "",
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", conn.table, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", conn.table)
+	}
+	return columns, nil
+}
+
+// missingColumns checks which columns of the table row has no field for,
+// once column_defaults have been applied. It returns the columns with a
+// DEFAULT, which are left out of the INSERT for the server to fill in, and
+// the first column that is neither Nullable nor has a DEFAULT, or an empty
+// string if there is none. Rows with such a column are rejected.
+func (conn *clickhouseConn) missingColumns(row map[string]any) (omitted []string, unfilled string) {
+	for _, column := range conn.insertColumns {
+		switch {
+		case hasField(row, column.name, conn.caseInsensitive), column.nullable:
+		case column.hasDefault:
+			omitted = append(omitted, column.name)
+		case unfilled == "":
+			unfilled = column.name
+		}
+	}
+	return omitted, unfilled
+}
+
+// omittedKey returns the columns missingColumns leaves out for row as a
+// single string, which rows are grouped by so that all rows of a batch
+// leave out the same columns.
+func (conn *clickhouseConn) omittedKey(row bufferedRow) string {
+	omitted, _ := conn.missingColumns(conn.columns.apply(row))
+	return strings.Join(omitted, "\x00")
+}
+
+// omittingQuery returns the INSERT statement for rows that leave out the
+// omitted columns, listing all other insertable columns explicitly.
+func (conn *clickhouseConn) omittingQuery(omitted []string) string {
+	skip := make(map[string]bool, len(omitted))
+	for _, name := range omitted {
+		skip[name] = true
+	}
+	var names []string
+	for _, column := range conn.insertColumns {
+		if !skip[column.name] {
+			names = append(names, quoteIdentifier(column.name))
+		}
+	}
+	return fmt.Sprintf("%s (%s)", insertQuery(conn.table, conn.queryComment), strings.Join(names, ", "))
+}
+
+// hasField reports whether row has a top level key for column, ignoring
+// case with caseInsensitive.
+func hasField(row map[string]any, column string, caseInsensitive bool) bool {
+	if _, ok := row[column]; ok {
+		return true
+	}
+	if caseInsensitive {
+		for key := range row {
+			if strings.EqualFold(key, column) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package chwriter
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// strictTestConn returns a writer in missing_columns strict mode for the
+// table uri String, region String DEFAULT 'eu', referer Nullable(String) and
+// user_id UInt64, which has neither a DEFAULT nor is Nullable.
+func strictTestConn() (*fakeConn, *clickhouseConn) {
+	fake := newFakeConn("uri String", "region String", "referer Nullable(String)", "user_id UInt64")
+	conn := newTestConn(fake)
+	conn.strictColumns = true
+	conn.insertColumns = []tableColumn{
+		{name: "uri"},
+		{name: "region", hasDefault: true},
+		{name: "referer", nullable: true},
+		{name: "user_id"},
+	}
+	return fake, conn
+}
+
+func TestMissingColumns(t *testing.T) {
+	_, conn := strictTestConn()
+	tests := []struct {
+		name         string
+		row          map[string]any
+		wantOmitted  []string
+		wantUnfilled string
+	}{
+		{"all present", map[string]any{"uri": "/", "region": "us", "referer": "x", "user_id": 1.0}, nil, ""},
+		{"nullable missing", map[string]any{"uri": "/", "region": "us", "user_id": 1.0}, nil, ""},
+		{"default missing", map[string]any{"uri": "/", "user_id": 1.0}, []string{"region"}, ""},
+		{"neither missing", map[string]any{"uri": "/", "region": "us"}, nil, "user_id"},
+		{"first unfilled", map[string]any{"region": "us"}, nil, "uri"},
+	}
+	for _, tt := range tests {
+		omitted, unfilled := conn.missingColumns(tt.row)
+		if !slices.Equal(omitted, tt.wantOmitted) || unfilled != tt.wantUnfilled {
+			t.Errorf("%s: missingColumns = %q, %q, want %q, %q",
+				tt.name, omitted, unfilled, tt.wantOmitted, tt.wantUnfilled)
+		}
+	}
+}
+
+func TestMissingColumnsCaseInsensitive(t *testing.T) {
+	_, conn := strictTestConn()
+	conn.caseInsensitive = true
+	row := map[string]any{"URI": "/", "Region": "us", "USER_ID": 1.0}
+	if omitted, unfilled := conn.missingColumns(row); omitted != nil || unfilled != "" {
+		t.Errorf("missingColumns = %q, %q, want no missing columns", omitted, unfilled)
+	}
+}
+
+// column_defaults are applied before columns are checked, so a default
+// fills in a column that would otherwise be omitted or unfilled.
+func TestMissingColumnsAfterDefaults(t *testing.T) {
+	fake, conn := strictTestConn()
+	conn.columns = columnMapping{defaults: map[string]any{"user_id": 7.0, "region": "ap"}}
+
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.stats.rowsRejected; n != 0 {
+		t.Errorf("rowsRejected = %d, want 0", n)
+	}
+	if got, want := fake.queries[0], insertQuery("logs", ""); got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+	rows := fake.rows()
+	if len(rows) != 1 {
+		t.Fatalf("sent %d rows, want 1", len(rows))
+	}
+	if rows[0][1] != "ap" || rows[0][3] != 7.0 {
+		t.Errorf("row = %v, want the column_defaults for region and user_id", rows[0])
+	}
+}
+
+func TestOmittingQuery(t *testing.T) {
+	_, conn := strictTestConn()
+	conn.queryComment = "caddy"
+	want := insertQuery("logs", "caddy") + " (`uri`, `referer`, `user_id`)"
+	if got := conn.omittingQuery([]string{"region"}); got != want {
+		t.Errorf("omittingQuery = %q, want %q", got, want)
+	}
+}
+
+// Rows that leave out a column with a DEFAULT are sent in their own batch
+// without it, rows that leave out a Nullable column send NULL, and rows that
+// leave out a column with neither are rejected.
+func TestStrictColumnsFlush(t *testing.T) {
+	fake, conn := strictTestConn()
+	lines := []string{
+		`{"uri":"/full","region":"us","referer":"x","user_id":1}`,
+		`{"uri":"/no-region","referer":"x","user_id":2}`,
+		`{"uri":"/no-referer","region":"us","user_id":3}`,
+		`{"uri":"/no-user","region":"us"}`,
+	}
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conn.stats.rowsRejected; n != 1 {
+		t.Errorf("rowsRejected = %d, want 1", n)
+	}
+	if n := conn.stats.rowsFlushed; n != 3 {
+		t.Errorf("rowsFlushed = %d, want 3", n)
+	}
+	omitting := conn.omittingQuery([]string{"region"})
+	var sawOmitting bool
+	for _, query := range fake.queries {
+		sawOmitting = sawOmitting || query == omitting
+	}
+	if !sawOmitting {
+		t.Errorf("queries = %q, want one leaving out region", fake.queries)
+	}
+
+	byURI := make(map[string][]any)
+	for _, row := range fake.rows() {
+		byURI[row[0].(string)] = row
+	}
+	if _, ok := byURI["/no-user"]; ok {
+		t.Errorf("sent the row without user_id")
+	}
+	if row := byURI["/no-region"]; len(row) != 3 || row[2] != 2.0 {
+		t.Errorf("row without region = %v, want uri, referer and user_id only", row)
+	}
+	if row := byURI["/no-referer"]; len(row) != 4 || row[2] != nil {
+		t.Errorf("row without referer = %v, want a NULL referer", row)
+	}
+	if row := byURI["/full"]; len(row) != 4 || row[1] != "us" {
+		t.Errorf("full row = %v, want all columns", row)
+	}
+}
+
+// In the default zero mode nothing is omitted or rejected: missing columns
+// are sent as nil and the driver fills in their zero value.
+func TestZeroColumnsFlush(t *testing.T) {
+	fake, conn := strictTestConn()
+	conn.strictColumns = false
+	conn.insertColumns = nil
+
+	if _, err := conn.Write([]byte(`{"uri":"/"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.stats.rowsRejected; n != 0 {
+		t.Errorf("rowsRejected = %d, want 0", n)
+	}
+	if got, want := fake.queries[0], insertQuery("logs", ""); got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+	rows := fake.rows()
+	if len(rows) != 1 {
+		t.Fatalf("sent %d rows, want 1", len(rows))
+	}
+	for i, value := range rows[0][1:] {
+		if value != nil {
+			t.Errorf("column %d = %v, want nil", i+1, value)
+		}
+	}
+}
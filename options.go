@@ -0,0 +1,186 @@
+package chwriter
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Protocols the writer can connect with.
+const (
+	protocolNative = "native"
+	protocolHTTP   = "http"
+)
+
+// compressionMethods maps the values of the compression option to the
+// driver's methods. The native protocol only supports block compression
+// (lz4, lz4hc and zstd); HTTP additionally supports compressing the whole
+// request body with gzip, deflate or br, sent with a matching
+// Content-Encoding header.
+var compressionMethods = map[string]clickhouse.CompressionMethod{
+	"none":    clickhouse.CompressionNone,
+	"lz4":     clickhouse.CompressionLZ4,
+	"lz4hc":   clickhouse.CompressionLZ4HC,
+	"zstd":    clickhouse.CompressionZSTD,
+	"gzip":    clickhouse.CompressionGZIP,
+	"deflate": clickhouse.CompressionDeflate,
+	"br":      clickhouse.CompressionBrotli,
+}
+
+// tlsVersions maps the values of the tls_min_version option to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsSetting is the value of the tls option. It is a boolean, but configs
+// from when the option was a string are still accepted: a JSON string is
+// parsed with strconv.ParseBool, except that the empty string means false.
+type tlsSetting bool
+
+// UnmarshalJSON accepts a JSON boolean or a string holding one.
+func (setting *tlsSetting) UnmarshalJSON(b []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(b, &enabled); err == nil {
+		*setting = tlsSetting(enabled)
+		return nil
+	}
+
+	var legacy string
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return fmt.Errorf("tls must be a boolean: %w", err)
+	}
+	if legacy == "" {
+		*setting = false
+		return nil
+	}
+	enabled, err := strconv.ParseBool(legacy)
+	if err != nil {
+		return fmt.Errorf("invalid tls value %q: %w", legacy, err)
+	}
+	*setting = tlsSetting(enabled)
+	return nil
+}
+
+// validateConnection checks the protocol, compression and TLS options and
+// that the table can be inserted into over the chosen protocol.
+func (writer *ClickHouseWriter) validateConnection() error {
+	if err := writer.validateTLS(); err != nil {
+		return err
+	}
+
+	switch writer.Protocol {
+	case "":
+		writer.Protocol = protocolNative
+	case protocolNative, protocolHTTP:
+	default:
+		return fmt.Errorf("invalid protocol: %s", writer.Protocol)
+	}
+
+	if writer.Protocol == protocolHTTP && isTableFunction(writer.Table) {
+		// Over HTTP the driver looks up the insert columns with DESC TABLE,
+		// which it cannot build for a table function.
+		return fmt.Errorf("table functions are not supported with protocol http")
+	}
+
+	if writer.Compression == "" {
+		return nil
+	}
+	method, ok := compressionMethods[writer.Compression]
+	if !ok {
+		return fmt.Errorf("invalid compression: %s", writer.Compression)
+	}
+	switch method {
+	case clickhouse.CompressionGZIP, clickhouse.CompressionDeflate, clickhouse.CompressionBrotli:
+		if writer.Protocol != protocolHTTP {
+			return fmt.Errorf("compression %s requires protocol http", writer.Compression)
+		}
+	case clickhouse.CompressionLZ4HC:
+		if writer.Protocol == protocolHTTP {
+			return fmt.Errorf("compression %s is not supported with protocol http", writer.Compression)
+		}
+	}
+	return nil
+}
+
+// validateTLS resolves tls_min_version and tls_cipher_suites. Cipher suites
+// are named as in crypto/tls, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+// and only the suites Go considers secure are accepted. The suites of TLS
+// 1.3 cannot be chosen and are rejected, since Go always enables all of
+// them.
+func (writer *ClickHouseWriter) validateTLS() error {
+	if (writer.TLSMinVersion != "" || len(writer.TLSCipherSuites) > 0) && !writer.TLS {
+		return fmt.Errorf("tls_min_version and tls_cipher_suites require tls")
+	}
+
+	if writer.TLSMinVersion != "" {
+		version, ok := tlsVersions[writer.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("invalid tls_min_version: %s", writer.TLSMinVersion)
+		}
+		writer.tlsMinVersion = version
+	}
+
+	for _, name := range writer.TLSCipherSuites {
+		suite := cipherSuite(name)
+		switch {
+		case suite == nil:
+			return fmt.Errorf("invalid tls_cipher_suites: unknown or insecure cipher suite %s", name)
+		case !slices.ContainsFunc(suite.SupportedVersions, func(version uint16) bool { return version < tls.VersionTLS13 }):
+			return fmt.Errorf("invalid tls_cipher_suites: %s is a TLS 1.3 cipher suite, which cannot be configured", name)
+		}
+		writer.tlsCipherSuites = append(writer.tlsCipherSuites, suite.ID)
+	}
+	return nil
+}
+
+// cipherSuite returns the secure cipher suite with the given name, or nil if
+// there is none.
+func cipherSuite(name string) *tls.CipherSuite {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
+
+// clickhouseOptions returns the driver options for connecting to the
+// configured server.
+func (writer *ClickHouseWriter) clickhouseOptions() *clickhouse.Options {
+	options := &clickhouse.Options{
+		Addr: []string{fmt.Sprintf("%s:%s", writer.Host, writer.Port)},
+		Auth: clickhouse.Auth{
+			Database: writer.DbName,
+			Username: writer.Username,
+			Password: writer.Password,
+		},
+	}
+	if writer.TLS {
+		options.TLS = &tls.Config{
+			MinVersion:   writer.tlsMinVersion,
+			CipherSuites: writer.tlsCipherSuites,
+		}
+	}
+	if writer.Protocol == protocolHTTP {
+		options.Protocol = clickhouse.HTTP
+	}
+	if writer.Compression != "" {
+		options.Compression = &clickhouse.Compression{Method: compressionMethods[writer.Compression]}
+	}
+	return options
+}
+
+// dualWriteOptions returns the driver options for connecting to the
+// dual_write server, which only differs from the primary in its address.
+func (writer *ClickHouseWriter) dualWriteOptions() *clickhouse.Options {
+	options := writer.clickhouseOptions()
+	options.Addr = []string{fmt.Sprintf("%s:%s", writer.DualWriteHost, writer.DualWritePort)}
+	return options
+}
@@ -0,0 +1,58 @@
+package chwriter
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestValidateTLS(t *testing.T) {
+	const ecdhe = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	tests := []struct {
+		name    string
+		writer  ClickHouseWriter
+		wantErr bool
+	}{
+		{"unset", ClickHouseWriter{}, false},
+		{"min version", ClickHouseWriter{TLS: true, TLSMinVersion: "1.2"}, false},
+		{"cipher suites", ClickHouseWriter{TLS: true, TLSCipherSuites: []string{ecdhe}}, false},
+		{"without tls", ClickHouseWriter{TLSMinVersion: "1.2"}, true},
+		{"unknown version", ClickHouseWriter{TLS: true, TLSMinVersion: "1.4"}, true},
+		{"unknown suite", ClickHouseWriter{TLS: true, TLSCipherSuites: []string{"TLS_NULL"}}, true},
+		{"insecure suite", ClickHouseWriter{TLS: true, TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, true},
+		{"tls 1.3 suite", ClickHouseWriter{TLS: true, TLSCipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.writer.validateTLS(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateTLS = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClickHouseOptionsTLS(t *testing.T) {
+	writer := &ClickHouseWriter{
+		TLS:             true,
+		TLSMinVersion:   "1.2",
+		TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+	if err := writer.validateTLS(); err != nil {
+		t.Fatal(err)
+	}
+	config := writer.clickhouseOptions().TLS
+	if config == nil {
+		t.Fatal("no TLS config with tls set")
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want TLS 1.2", config.MinVersion)
+	}
+	if !slices.Equal(config.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("CipherSuites = %v, want the configured suite", config.CipherSuites)
+	}
+
+	if config := (&ClickHouseWriter{TLS: true}).clickhouseOptions().TLS; config.MinVersion != 0 || config.CipherSuites != nil {
+		t.Errorf("defaults: %+v, want Go's defaults", config)
+	}
+	if config := (&ClickHouseWriter{}).clickhouseOptions().TLS; config != nil {
+		t.Error("TLS config without tls")
+	}
+}
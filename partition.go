@@ -0,0 +1,57 @@
+package chwriter
+
+import "fmt"
+
+// Values of the partition_by option, the granularity at which a timestamp
+// partition field is grouped.
+const (
+	partitionByHour  = "hour"
+	partitionByDay   = "day"
+	partitionByMonth = "month"
+)
+
+// partitionKey returns the value of the partition field of row, which rows
+// are grouped by so that each insert batch falls into a single partition.
+// With partition_by, the field is parsed as a timestamp and truncated to the
+// hour, day or month in UTC, matching partition keys such as
+// toYYYYMMDD(ts). Rows without the field, or whose timestamp cannot be
+// parsed, share the empty key.
+func (conn *clickhouseConn) partitionKey(row bufferedRow) string {
+	value := conn.partitionField.lookup(row.fields)
+	if value == nil {
+		return ""
+	}
+	if conn.partitionBy == "" {
+		return fmt.Sprint(value)
+	}
+
+	ts, ok := parseTimestamp(value, conn.columns.timestampLayout)
+	if !ok {
+		return ""
+	}
+	ts = ts.UTC()
+	switch conn.partitionBy {
+	case partitionByHour:
+		return ts.Format("2006010215")
+	case partitionByDay:
+		return ts.Format("20060102")
+	default:
+		return ts.Format("200601")
+	}
+}
+
+// groupKey returns the key rows are grouped by before they are sent, given
+// whether they are also being split by shape. With missing_columns strict,
+// rows are also split by the columns they leave out, see omittedKey.
+func (conn *clickhouseConn) groupKey(splitShapes bool) func(bufferedRow) string {
+	return func(row bufferedRow) string {
+		key := conn.partitionKey(row)
+		if splitShapes {
+			key = rowShape(row) + "\x01" + key
+		}
+		if conn.strictColumns {
+			key += "\x01" + conn.omittedKey(row)
+		}
+		return key
+	}
+}
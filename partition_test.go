@@ -0,0 +1,135 @@
+package chwriter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// partitionTestConn returns a writer for the table day String, uri String
+// that groups rows by the day field.
+func partitionTestConn() (*fakeConn, *clickhouseConn) {
+	fake := newFakeConn("day String", "uri String")
+	conn := newTestConn(fake)
+	conn.partitionField = mustParsePath("day")
+	return fake, conn
+}
+
+func writePartitionLines(tb testing.TB, conn *clickhouseConn, lines ...string) {
+	tb.Helper()
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// partitionsPerBatch returns the days in each sent batch.
+func partitionsPerBatch(fake *fakeConn) [][]any {
+	var days [][]any
+	for _, batch := range fake.sentBatches() {
+		var batchDays []any
+		seen := make(map[any]bool)
+		for _, row := range batch {
+			if !seen[row[0]] {
+				seen[row[0]] = true
+				batchDays = append(batchDays, row[0])
+			}
+		}
+		days = append(days, batchDays)
+	}
+	return days
+}
+
+func TestPartitionFieldSplitsBatches(t *testing.T) {
+	fake, conn := partitionTestConn()
+	writePartitionLines(t, conn,
+		`{"day":"2024-05-01","uri":"/a"}`,
+		`{"day":"2024-05-02","uri":"/b"}`,
+		`{"day":"2024-05-01","uri":"/c"}`,
+		`{"day":"2024-05-03","uri":"/d"}`,
+	)
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := fmt.Sprint(partitionsPerBatch(fake))
+	if want := "[[2024-05-01] [2024-05-02] [2024-05-03]]"; got != want {
+		t.Errorf("days per batch = %s, want %s", got, want)
+	}
+	if rows := fake.rows(); len(rows) != 4 || rows[0][1] != "/a" || rows[1][1] != "/c" {
+		t.Errorf("rows = %v, want the rows of each day in the order written", rows)
+	}
+}
+
+// Rows without the field are sent together in one batch.
+func TestPartitionFieldMissing(t *testing.T) {
+	fake, conn := partitionTestConn()
+	writePartitionLines(t, conn, `{"uri":"/a"}`, `{"uri":"/b"}`, `{"uri":"/c"}`)
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if batches := fake.sentBatches(); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("sent %d batches, want the 3 rows in one", len(batches))
+	}
+}
+
+// rows_per_send still applies within each partition, and no batch spans two.
+func TestPartitionFieldKeepsRowsPerSend(t *testing.T) {
+	fake, conn := partitionTestConn()
+	conn.rowsPerSend = 2
+	for i := range 5 {
+		writePartitionLines(t, conn, fmt.Sprintf(`{"day":"2024-05-01","uri":"/%d"}`, i))
+	}
+	writePartitionLines(t, conn, `{"day":"2024-05-02","uri":"/x"}`)
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, batch := range fake.sentBatches() {
+		sizes = append(sizes, len(batch))
+	}
+	if got, want := fmt.Sprint(sizes), "[2 2 1 1]"; got != want {
+		t.Errorf("batch sizes = %s, want %s", got, want)
+	}
+	for i, days := range partitionsPerBatch(fake) {
+		if len(days) != 1 {
+			t.Errorf("batch %d spans days %v", i, days)
+		}
+	}
+}
+
+// BenchmarkPartitionParts flushes rows spread over several days in chunks
+// of rows_per_send, with and without partition_field. parts/flush counts
+// the parts the server would create, one per partition an insert touches.
+func BenchmarkPartitionParts(b *testing.B) {
+	const rows, days = 1000, 4
+	for _, grouped := range []bool{false, true} {
+		b.Run(fmt.Sprintf("grouped=%t", grouped), func(b *testing.B) {
+			var parts int
+			for range b.N {
+				b.StopTimer()
+				fake, conn := partitionTestConn()
+				conn.rowsPerSend = 100
+				if !grouped {
+					conn.partitionField = nil
+				}
+				for i := range rows {
+					writePartitionLines(b, conn, fmt.Sprintf(`{"day":"2024-05-%02d","uri":"/"}`, i%days+1))
+				}
+				b.StartTimer()
+				if err := conn.flush(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				parts = 0
+				for _, batchDays := range partitionsPerBatch(fake) {
+					parts += len(batchDays)
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(parts), "parts/flush")
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package chwriter
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A field path selects a value from a decoded log line. It is a small subset
+// of JSONPath without the leading "$": dot separated object keys, each
+// optionally followed by any number of array subscripts.
+//
+//	request.host             object keys
+//	request.headers.Via[0]   the first element of an array
+//	request.headers.*[0]     the first header value of any header
+//	items[*].id              the id of the first element that has one
+//
+// A "*" key or "[*]" subscript is a wildcard: the rest of the path is
+// evaluated against each object value (in key order) or array element, and
+// the first value found is the result. Keys cannot contain dots or brackets.
+
+// pathStepKind is what a step of a field path matches.
+type pathStepKind int
+
+const (
+	stepKey pathStepKind = iota
+	stepIndex
+	stepWildcard
+)
+
+// pathStep is one key, subscript or wildcard of a field path.
+type pathStep struct {
+	kind  pathStepKind
+	key   string
+	index int
+}
+
+// fieldPath is a parsed field path. Paths are parsed once, when the writer
+// is provisioned, rather than on every lookup. The nil fieldPath is an
+// unset path and matches nothing.
+type fieldPath []pathStep
+
+// parsePath parses a field path into its steps.
+func parsePath(path string) (fieldPath, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty field path")
+	}
+
+	var steps fieldPath
+	for _, segment := range strings.Split(path, ".") {
+		name, subscripts := segment, ""
+		if i := strings.IndexByte(segment, '['); i >= 0 {
+			name, subscripts = segment[:i], segment[i:]
+		}
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("invalid field path %q: empty key", path)
+		case name == "*":
+			steps = append(steps, pathStep{kind: stepWildcard})
+		case strings.ContainsAny(name, "]*"):
+			return nil, fmt.Errorf("invalid field path %q: invalid key %q", path, name)
+		default:
+			steps = append(steps, pathStep{kind: stepKey, key: name})
+		}
+
+		for subscripts != "" {
+			if subscripts[0] != '[' {
+				return nil, fmt.Errorf("invalid field path %q: unexpected %q after subscript", path, subscripts)
+			}
+			inner, rest, ok := strings.Cut(subscripts[1:], "]")
+			if !ok {
+				return nil, fmt.Errorf("invalid field path %q: unterminated subscript", path)
+			}
+			if inner == "*" {
+				steps = append(steps, pathStep{kind: stepWildcard})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid field path %q: invalid array index %q", path, inner)
+				}
+				steps = append(steps, pathStep{kind: stepIndex, index: index})
+			}
+			subscripts = rest
+		}
+	}
+	return steps, nil
+}
+
+// mustParsePath is like parsePath but panics if path is invalid. It is
+// meant for the paths of the fields of Caddy's access log the writer reads.
+func mustParsePath(path string) fieldPath {
+	steps, err := parsePath(path)
+	if err != nil {
+		panic(err)
+	}
+	return steps
+}
+
+// parsePaths parses every path of paths, see parsePath.
+func parsePaths(paths []string) ([]fieldPath, error) {
+	parsed := make([]fieldPath, len(paths))
+	for i, path := range paths {
+		var err error
+		if parsed[i], err = parsePath(path); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// lookup returns the value at path in row, or nil if nothing matches.
+func (path fieldPath) lookup(row map[string]any) any {
+	if path == nil {
+		return nil
+	}
+	return evalPath(row, path)
+}
+
+// evalPath returns the value steps select from value, or nil if nothing
+// matches.
+func evalPath(value any, steps []pathStep) any {
+	if len(steps) == 0 {
+		return value
+	}
+	step, rest := steps[0], steps[1:]
+
+	switch step.kind {
+	case stepKey:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		return evalPath(object[step.key], rest)
+	case stepIndex:
+		array, ok := value.([]any)
+		if !ok || step.index >= len(array) {
+			return nil
+		}
+		return evalPath(array[step.index], rest)
+	case stepWildcard:
+		switch value := value.(type) {
+		case []any:
+			for _, element := range value {
+				if found := evalPath(element, rest); found != nil {
+					return found
+				}
+			}
+		case map[string]any:
+			for _, key := range slices.Sorted(maps.Keys(value)) {
+				if found := evalPath(value[key], rest); found != nil {
+					return found
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package chwriter
+
+import "testing"
+
+func TestFieldPathLookup(t *testing.T) {
+	row := map[string]any{
+		"request": map[string]any{
+			"host":    "example.com",
+			"headers": map[string]any{"Via": []any{"1.1 a", "1.1 b"}},
+		},
+		"items": []any{map[string]any{}, map[string]any{"id": "x"}},
+	}
+	tests := []struct {
+		path string
+		want any
+	}{
+		{"request.host", "example.com"},
+		{"request.headers.Via[1]", "1.1 b"},
+		{"request.headers.*[0]", "1.1 a"},
+		{"items[*].id", "x"},
+		{"request.missing", nil},
+		{"request.headers.Via[5]", nil},
+	}
+	for _, tt := range tests {
+		path, err := parsePath(tt.path)
+		if err != nil {
+			t.Fatalf("parsePath(%q): %v", tt.path, err)
+		}
+		if got := path.lookup(row); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	var unset fieldPath
+	if got := unset.lookup(row); got != nil {
+		t.Errorf("unset path: %v, want nil", got)
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for _, path := range []string{"", "a..b", "a[", "a[-1]", "a[x]", "a]b", "a[0]b"} {
+		if _, err := parsePath(path); err == nil {
+			t.Errorf("parsePath(%q) succeeded, want an error", path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package chwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"go.uber.org/zap"
+)
+
+// reconnectLoop replaces the connections to the server every
+// reconnectEvery until the writer is closed, see reconnect.
+func (conn *clickhouseConn) reconnectLoop() {
+	defer conn.wg.Done()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-time.After(conn.reconnectEvery):
+			if err := conn.reconnect(); err != nil {
+				conn.logger.Error("scheduled reconnect failed, keeping the current connection",
+					zap.String("writer", conn.key), zap.Error(err))
+				continue
+			}
+			conn.logger.Info("reconnected to ClickHouse on schedule", zap.String("writer", conn.key))
+		}
+	}
+}
+
+// reconnect opens and pings new connections to the server and, with
+// dual_write, the secondary server, resolving their host names again, and
+// swaps them in for the current ones. Flushes, stats writes and circuit
+// probes hold connMu for reading while they use the connections, so the
+// swap waits for any of them in progress to finish, and only then are the
+// current connections closed. If a new connection cannot be opened, the
+// current ones are kept.
+func (conn *clickhouseConn) reconnect() error {
+	primary, err := conn.dial(conn.options)
+	if err != nil {
+		return err
+	}
+	var secondary driver.Conn
+	if conn.secondaryOpts != nil {
+		if secondary, err = conn.dial(conn.secondaryOpts); err != nil {
+			primary.Close()
+			return fmt.Errorf("dual_write server: %w", err)
+		}
+	}
+
+	conn.connMu.Lock()
+	oldPrimary, oldSecondary := conn.Conn, conn.secondary
+	conn.Conn, conn.secondary = primary, secondary
+	conn.connMu.Unlock()
+
+	err = oldPrimary.Close()
+	if oldSecondary != nil {
+		err = errors.Join(err, oldSecondary.Close())
+	}
+	if err != nil {
+		conn.logger.Warn("failed to close replaced connection", zap.String("writer", conn.key), zap.Error(err))
+	}
+	return nil
+}
+
+// dial opens a connection with options and pings it, so that a server that
+// cannot be reached does not replace a working connection on reconnect.
+func (conn *clickhouseConn) dial(options *clickhouse.Options) (driver.Conn, error) {
+	c, err := clickhouse.Open(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", wrapAuthError(err, conn.username))
+	}
+	if err := c.Ping(conn.queryContext(context.Background())); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to ping ClickHouse: %w", wrapAuthError(err, conn.username))
+	}
+	return c, nil
+}
+
+// open opens a connection with options for OpenWriter. clickhouse.Open does
+// not dial the server, so open pings it to report rejected credentials now
+// rather than at the first flush. Any other ping error, such as a server
+// that cannot be reached, is only logged: the connection is kept and dials
+// again when it is next used, while rows are buffered and flushes retried,
+// so that Caddy can still start or reload its config during an outage.
+func (conn *clickhouseConn) open(options *clickhouse.Options) (driver.Conn, error) {
+	c, err := clickhouse.Open(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %w", wrapAuthError(err, conn.username))
+	}
+	if err := c.Ping(conn.queryContext(context.Background())); err != nil {
+		if isAuthError(err) {
+			c.Close()
+			return nil, fmt.Errorf("failed to ping ClickHouse: %w", wrapAuthError(err, conn.username))
+		}
+		conn.logger.Warn("failed to ping ClickHouse, buffering rows until it can be reached",
+			zap.String("writer", conn.key), zap.Strings("addr", options.Addr), zap.Error(err))
+	}
+	return c, nil
+}
@@ -0,0 +1,49 @@
+package chwriter
+
+import (
+	"testing"
+	"time"
+)
+
+// A reconnect that fails keeps the current connection, and closing done
+// stops the loop whether it is waiting for the next reconnect or not.
+func TestReconnectLoopStops(t *testing.T) {
+	for _, every := range []time.Duration{time.Millisecond, time.Hour} {
+		fake := newFakeConn("uri String")
+		conn := newTestConn(fake)
+		conn.options = unreachableOptions(t)
+		conn.reconnectEvery = every
+
+		conn.wg.Add(1)
+		go conn.reconnectLoop()
+		time.Sleep(20 * time.Millisecond)
+		close(conn.done)
+
+		stopped := make(chan struct{})
+		go func() {
+			conn.wg.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("reconnect every %v: loop did not stop after done was closed", every)
+		}
+		if conn.Conn != fake || fake.isClosed() {
+			t.Errorf("reconnect every %v: failed reconnects replaced or closed the connection", every)
+		}
+	}
+}
+
+func TestReconnectFailureKeepsConnection(t *testing.T) {
+	fake := newFakeConn("uri String")
+	conn := newTestConn(fake)
+	conn.options = unreachableOptions(t)
+
+	if err := conn.reconnect(); err == nil {
+		t.Fatal("reconnect to an unreachable server succeeded")
+	}
+	if conn.Conn != fake || fake.isClosed() {
+		t.Errorf("failed reconnect replaced or closed the connection")
+	}
+}
@@ -0,0 +1,130 @@
+package chwriter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Policies for log lines that do not decode to a JSON object.
+const (
+	nonObjectError = "error"
+	nonObjectSkip  = "skip"
+	nonObjectWrap  = "wrap"
+)
+
+// Policies for fields that have no column, see on_extra_field.
+const (
+	extraFieldIgnore   = "ignore"
+	extraFieldError    = "error"
+	extraFieldRouteRaw = "route_raw"
+)
+
+// bufferedRow is a log line waiting in the buffer to be flushed.
+type bufferedRow struct {
+	// fields holds the decoded JSON object of the line.
+	fields map[string]any
+	// receivedAt is when Write received the line.
+	receivedAt time.Time
+	// raw is the line as written, kept for on_extra_field route_raw only.
+	raw []byte
+	// packed holds the line compressed instead of fields and raw once the
+	// buffer is over buffer_compress_threshold, see pack.
+	packed *packedRow
+}
+
+// appendRow appends the fields of a decoded log line to the batch, matching
+// them to the batch's columns by key. Columns without a matching key receive
+// nil and keys without a matching column are ignored.
+//
+// With caseInsensitive, a column that has no key of exactly the same name is
+// matched to a top level key that differs only in case. If several keys do,
+// the one that sorts first byte-wise wins, so "Status" is preferred over
+// "status" and "STATUS" over both.
+//
+// If nullable is not nil, empty strings bound for the columns it marks, see
+// nullableColumns, are appended as NULL.
+func appendRow(batch driver.Batch, row map[string]any, caseInsensitive bool, nullable []bool) error {
+	var folded map[string]any
+	if caseInsensitive {
+		folded = foldKeys(row)
+	}
+
+	columns := batch.Columns()
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		value, ok := row[column.Name()]
+		if !ok && caseInsensitive {
+			value = folded[strings.ToLower(column.Name())]
+		}
+		if nullable != nil && nullable[i] && value == "" {
+			value = nil
+		}
+		values[i] = value
+	}
+	return batch.Append(values...)
+}
+
+// columnNames returns the names of the columns of batch, in lower case with
+// caseInsensitive.
+func columnNames(batch driver.Batch, caseInsensitive bool) map[string]bool {
+	columns := batch.Columns()
+	names := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		name := column.Name()
+		if caseInsensitive {
+			name = strings.ToLower(name)
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// extraField returns a top level key of row that matches none of columns, as
+// returned by columnNames, or an empty string if every key has a column.
+func extraField(row map[string]any, columns map[string]bool, caseInsensitive bool) string {
+	for key := range row {
+		name := key
+		if caseInsensitive {
+			name = strings.ToLower(key)
+		}
+		if !columns[name] {
+			return key
+		}
+	}
+	return ""
+}
+
+// nullableColumns reports for each column of batch whether it is Nullable,
+// including LowCardinality(Nullable(...)) columns.
+func nullableColumns(batch driver.Batch) []bool {
+	columns := batch.Columns()
+	nullable := make([]bool, len(columns))
+	for i, column := range columns {
+		nullable[i] = isNullableType(string(column.Type()))
+	}
+	return nullable
+}
+
+// isNullableType reports whether a ClickHouse column type is Nullable,
+// including LowCardinality(Nullable(...)).
+func isNullableType(typ string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(typ, "LowCardinality("), "Nullable(")
+}
+
+// foldKeys returns row keyed by lower case keys, resolving keys that collide
+// after folding in favor of the one that sorts first.
+func foldKeys(row map[string]any) map[string]any {
+	folded := make(map[string]any, len(row))
+	chosen := make(map[string]string, len(row))
+	for key, value := range row {
+		lower := strings.ToLower(key)
+		if prev, ok := chosen[lower]; ok && prev < key {
+			continue
+		}
+		chosen[lower] = key
+		folded[lower] = value
+	}
+	return folded
+}
@@ -0,0 +1,122 @@
+package chwriter
+
+import (
+	"context"
+	"testing"
+)
+
+// appendTestRow appends row to a batch of table and returns the values
+// appendRow passed for its columns.
+func appendTestRow(t *testing.T, table []string, row map[string]any, caseInsensitive bool, nullable bool) []any {
+	t.Helper()
+	batch, err := newFakeConn(table...).PrepareBatch(context.Background(), insertQuery("logs", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var columns []bool
+	if nullable {
+		columns = nullableColumns(batch)
+	}
+	if err := appendRow(batch, row, caseInsensitive, columns); err != nil {
+		t.Fatalf("appendRow: %v", err)
+	}
+	return batch.(*fakeBatch).rows[0]
+}
+
+func TestAppendRowCaseInsensitive(t *testing.T) {
+	table := []string{"status String", "uri String"}
+	tests := []struct {
+		name            string
+		row             map[string]any
+		caseInsensitive bool
+		want            []any
+	}{
+		{"exact", map[string]any{"status": "200", "uri": "/"}, false, []any{"200", "/"}},
+		{"case sensitive", map[string]any{"Status": "200", "URI": "/"}, false, []any{nil, nil}},
+		{"folded", map[string]any{"Status": "200", "URI": "/"}, true, []any{"200", "/"}},
+		{"exact wins", map[string]any{"status": "exact", "Status": "folded"}, true, []any{"exact", nil}},
+		{"first byte-wise", map[string]any{"Uri": "b", "URI": "a", "uri2": "c"}, true, []any{nil, "a"}},
+		{"absent", map[string]any{"host": "example.com"}, true, []any{nil, nil}},
+	}
+	for _, tt := range tests {
+		got := appendTestRow(t, table, tt.row, tt.caseInsensitive, false)
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: column %s = %v, want %v", tt.name, table[i], got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAppendRowEmptyStringAsNull(t *testing.T) {
+	table := []string{"referer Nullable(String)", "uri String", "agent LowCardinality(Nullable(String))"}
+	empty := map[string]any{"referer": "", "uri": "", "agent": ""}
+
+	got := appendTestRow(t, table, empty, false, true)
+	if got[0] != nil || got[1] != "" || got[2] != nil {
+		t.Errorf("empty_string_as_null: %q, want NULL for the Nullable columns only", got)
+	}
+	got = appendTestRow(t, table, map[string]any{"referer": "https://a/", "uri": "/", "agent": "curl"}, false, true)
+	if got[0] != "https://a/" || got[1] != "/" || got[2] != "curl" {
+		t.Errorf("non-empty values: %q, want them unchanged", got)
+	}
+	got = appendTestRow(t, table, empty, false, false)
+	if got[0] != "" || got[2] != "" {
+		t.Errorf("without empty_string_as_null: %q, want empty strings", got)
+	}
+}
+
+func TestIsNullableType(t *testing.T) {
+	for typ, want := range map[string]bool{
+		"Nullable(String)":                 true,
+		"LowCardinality(Nullable(String))": true,
+		"LowCardinality(String)":           false,
+		"String":                           false,
+		"Array(Nullable(String))":          false,
+	} {
+		if got := isNullableType(typ); got != want {
+			t.Errorf("isNullableType(%q) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestOnExtraField(t *testing.T) {
+	known := `{"uri":"/a"}`
+	extra := `{"uri":"/b","upstream":"10.0.0.1"}`
+	tests := []struct {
+		mode     string
+		want     [][]any
+		rejected uint64
+	}{
+		{extraFieldIgnore, [][]any{{"/a", nil}, {"/b", nil}}, 0},
+		{extraFieldError, [][]any{{"/a", nil}}, 1},
+		{extraFieldRouteRaw, [][]any{{"/a", nil}, {"/b", extra}}, 0},
+	}
+	for _, tt := range tests {
+		fake := newFakeConn("uri String", "raw String")
+		conn := newTestConn(fake)
+		conn.extraFields = tt.mode
+		conn.rawColumn = "raw"
+		for _, line := range []string{known, extra} {
+			if _, err := conn.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conn.flush(context.Background()); err != nil {
+			t.Fatalf("%s: flush: %v", tt.mode, err)
+		}
+
+		rows := fake.rows()
+		if len(rows) != len(tt.want) {
+			t.Fatalf("%s: sent %v, want %v", tt.mode, rows, tt.want)
+		}
+		for i := range rows {
+			if rows[i][0] != tt.want[i][0] || rows[i][1] != tt.want[i][1] {
+				t.Errorf("%s: row %d = %v, want %v", tt.mode, i, rows[i], tt.want[i])
+			}
+		}
+		if conn.stats.rowsRejected != tt.rejected {
+			t.Errorf("%s: %d rows rejected, want %d", tt.mode, conn.stats.rowsRejected, tt.rejected)
+		}
+	}
+}
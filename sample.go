@@ -0,0 +1,27 @@
+package chwriter
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// sampled reports whether sample_rate keeps a log line. With sample_key the
+// decision only depends on the value of the key field, hashed with xxhash,
+// so that lines sharing it, such as the requests of one trace or session,
+// are either all kept or all dropped, on every host and across restarts.
+// Lines without the key are sampled at random.
+func (conn *clickhouseConn) sampled(fields map[string]any) bool {
+	if conn.sampleRate == 0 || conn.sampleRate >= 1 {
+		return true
+	}
+	if conn.sampleKey != nil {
+		if value := conn.sampleKey.lookup(fields); value != nil {
+			hash := xxhash.Sum64String(fmt.Sprint(value))
+			return float64(hash) < conn.sampleRate*math.MaxUint64
+		}
+	}
+	return rand.Float64() < conn.sampleRate
+}
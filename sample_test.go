@@ -0,0 +1,104 @@
+package chwriter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Lines with the same sample_key value get the same decision every time,
+// and the share of keys kept is close to sample_rate.
+func TestSampledByKey(t *testing.T) {
+	conn := newTestConn(newFakeConn())
+	conn.sampleRate = 0.25
+	conn.sampleKey = mustParsePath("trace.id")
+
+	const keys = 10000
+	kept := 0
+	for i := range keys {
+		fields := map[string]any{"trace": map[string]any{"id": fmt.Sprintf("trace-%d", i)}}
+		first := conn.sampled(fields)
+		for range 3 {
+			if conn.sampled(fields) != first {
+				t.Fatalf("trace-%d: sampled differently on repeated lines", i)
+			}
+		}
+		if first {
+			kept++
+		}
+	}
+	if share := float64(kept) / keys; math.Abs(share-conn.sampleRate) > 0.02 {
+		t.Errorf("kept %.3f of keys, want about %.2f", share, conn.sampleRate)
+	}
+}
+
+// The decision only depends on the key, not on the rest of the line or on the
+// writer making it, so every host makes the same one.
+func TestSampledByKeyIgnoresOtherFields(t *testing.T) {
+	a := newTestConn(newFakeConn())
+	a.sampleRate = 0.5
+	a.sampleKey = mustParsePath("session")
+	b := newTestConn(newFakeConn())
+	b.sampleRate = 0.5
+	b.sampleKey = mustParsePath("session")
+
+	for i := range 100 {
+		session := fmt.Sprintf("s%d", i)
+		got := a.sampled(map[string]any{"session": session, "uri": "/a"})
+		if b.sampled(map[string]any{"session": session, "uri": "/b", "status": 500.0}) != got {
+			t.Errorf("session %s: sampled differently for different lines", session)
+		}
+	}
+}
+
+func TestSampledKeepsEverything(t *testing.T) {
+	for _, rate := range []float64{0, 1} {
+		conn := newTestConn(newFakeConn())
+		conn.sampleRate = rate
+		conn.sampleKey = mustParsePath("trace_id")
+		for i := range 100 {
+			if !conn.sampled(map[string]any{"trace_id": i}) {
+				t.Errorf("sample_rate %v dropped trace_id %d", rate, i)
+			}
+			if !conn.sampled(map[string]any{}) {
+				t.Errorf("sample_rate %v dropped a line without trace_id", rate)
+			}
+		}
+	}
+}
+
+// Lines without the key are sampled at random at sample_rate.
+func TestSampledWithoutKey(t *testing.T) {
+	conn := newTestConn(newFakeConn())
+	conn.sampleRate = 0.5
+	conn.sampleKey = mustParsePath("trace_id")
+
+	const lines = 10000
+	kept := 0
+	for range lines {
+		if conn.sampled(map[string]any{"uri": "/"}) {
+			kept++
+		}
+	}
+	if share := float64(kept) / lines; math.Abs(share-conn.sampleRate) > 0.05 {
+		t.Errorf("kept %.3f of lines without the key, want about %.2f", share, conn.sampleRate)
+	}
+}
+
+func TestWriteCountsSampledOut(t *testing.T) {
+	conn := newTestConn(newFakeConn("trace_id String"))
+	conn.sampleRate = 0.5
+	conn.sampleKey = mustParsePath("trace_id")
+
+	const lines = 200
+	for i := range lines {
+		line := fmt.Sprintf(`{"trace_id":"t%d"}`, i)
+		if _, err := conn.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffered, sampledOut := len(conn.buffer), conn.stats.rowsSampledOut
+	if buffered+int(sampledOut) != lines || sampledOut == 0 || buffered == 0 {
+		t.Errorf("buffered %d and sampled out %d of %d lines", buffered, sampledOut, lines)
+	}
+}
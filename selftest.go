@@ -0,0 +1,108 @@
+package chwriter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// selfTestSuffix is appended to the table name to form the name of the
+// throwaway table written by the self test, see selfTestTable.
+const selfTestSuffix = "_chwriter_self_test"
+
+// selfTestTable returns the name of the self test table for table: the
+// table part of the name with selfTestSuffix appended, in the same
+// database, quoted again so that quoted names stay valid.
+func selfTestTable(table string) string {
+	database, name := splitTable(table)
+	scratch := quoteIdentifier(name + selfTestSuffix)
+	if database != "" {
+		scratch = quoteIdentifier(database) + "." + scratch
+	}
+	return scratch
+}
+
+// selfTest exercises the full insert path at startup without touching the
+// destination table: it creates a Memory table with the destination's
+// schema, inserts a row of zero values through a batch and drops the table
+// again. This requires the CREATE TABLE, INSERT and DROP TABLE privileges on
+// the destination database.
+func (conn *clickhouseConn) selfTest() (err error) {
+	ctx := conn.queryContext(context.Background())
+	scratch := selfTestTable(conn.table)
+
+	if err := conn.Conn.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS %s ENGINE = Memory", scratch, conn.table)); err != nil {
+		return fmt.Errorf("failed to create self test table %s: %w", scratch, wrapAuthError(err, conn.username))
+	}
+	defer func() {
+		if dropErr := conn.Conn.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", scratch)); dropErr != nil && err == nil {
+			err = fmt.Errorf("failed to drop self test table %s: %w", scratch, dropErr)
+		}
+	}()
+
+	batch, err := conn.Conn.PrepareBatch(ctx, insertQuery(scratch, conn.queryComment))
+	if err != nil {
+		return fmt.Errorf("failed to prepare self test batch: %w", err)
+	}
+	defer batch.Close()
+
+	if err := batch.Append(zeroRow(batch)...); err != nil {
+		return fmt.Errorf("failed to append self test row: %w", err)
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("failed to send self test batch: %w", err)
+	}
+	return nil
+}
+
+// zeroRow returns a row holding the zero value of every column of batch.
+func zeroRow(batch driver.Batch) []any {
+	columns := batch.Columns()
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		values[i] = reflect.Zero(column.ScanType()).Interface()
+		if _, ok := values[i].(time.Time); ok {
+			// The zero time.Time lies before the range of DateTime columns.
+			values[i] = time.Unix(0, 0)
+		}
+		if name, ok := firstEnumName(string(column.Type())); ok {
+			// Enum columns only accept the names they declare.
+			values[i] = name
+		}
+	}
+	return values
+}
+
+// firstEnumName returns the name of the first element of an Enum8 or Enum16
+// type such as Enum8('GET' = 1, 'POST' = 2), with backslash escapes
+// removed.
+func firstEnumName(typ string) (string, bool) {
+	rest, ok := strings.CutPrefix(typ, "Enum8(")
+	if !ok {
+		if rest, ok = strings.CutPrefix(typ, "Enum16("); !ok {
+			return "", false
+		}
+	}
+	rest, ok = strings.CutPrefix(strings.TrimSpace(rest), "'")
+	if !ok {
+		return "", false
+	}
+	var name strings.Builder
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			if i++; i < len(rest) {
+				name.WriteByte(rest[i])
+			}
+		case '\'':
+			return name.String(), true
+		default:
+			name.WriteByte(rest[i])
+		}
+	}
+	return "", false
+}
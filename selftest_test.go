@@ -0,0 +1,70 @@
+package chwriter
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFirstEnumName(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want string
+		ok   bool
+	}{
+		{"Enum8('GET' = 1, 'POST' = 2)", "GET", true},
+		{"Enum16('a' = -5, 'b' = 300)", "a", true},
+		{`Enum8('it\'s' = 1)`, "it's", true},
+		{`Enum8('back\\slash' = 1)`, `back\slash`, true},
+		{"Enum8('' = 0, 'x' = 1)", "", true},
+		{"String", "", false},
+		{"Nullable(Enum8('a' = 1))", "", false},
+		{"Enum8('unterminated", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := firstEnumName(tt.typ)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("firstEnumName(%q) = %q, %v, want %q, %v", tt.typ, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSelfTestTable(t *testing.T) {
+	tests := []struct {
+		table, want string
+	}{
+		{"logs", "`logs_chwriter_self_test`"},
+		{"analytics.logs", "`analytics`.`logs_chwriter_self_test`"},
+		{"`analytics`.`logs`", "`analytics`.`logs_chwriter_self_test`"},
+		{`"analytics"."logs"`, "`analytics`.`logs_chwriter_self_test`"},
+		{"`logs`", "`logs_chwriter_self_test`"},
+	}
+	for _, tt := range tests {
+		if got := selfTestTable(tt.table); got != tt.want {
+			t.Errorf("selfTestTable(%q) = %q, want %q", tt.table, got, tt.want)
+		}
+	}
+}
+
+// The driver must accept every value of the zero row, which it does not
+// for an empty string in an Enum column.
+func TestZeroRowAppends(t *testing.T) {
+	fake := newFakeConn(
+		"method Enum8('GET' = 1, 'POST' = 2)",
+		"proto Enum16('HTTP/1.1' = 11, 'HTTP/2.0' = 20)",
+		"status Nullable(Enum8('ok' = 1))",
+		"ts DateTime64(3)",
+		"uri String",
+		"size UInt64",
+	)
+	batch, err := fake.PrepareBatch(context.Background(), insertQuery("logs", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := zeroRow(batch)
+	if err := batch.Append(row...); err != nil {
+		t.Fatalf("append zero row: %v", err)
+	}
+	if row[0] != "GET" || row[1] != "HTTP/1.1" {
+		t.Errorf("enum values = %v, %v, want GET and HTTP/1.1", row[0], row[1])
+	}
+}
@@ -0,0 +1,49 @@
+package chwriter
+
+import (
+	"slices"
+	"strings"
+)
+
+// Values of the validate_row_shapes option.
+const (
+	rowShapesWarn  = "warn"
+	rowShapesSplit = "split"
+)
+
+// rowShape identifies the set of top level keys of a decoded row, so that
+// rows with equal shapes map onto the same columns. Derived columns are not
+// part of the shape: they are set on a copy of the fields when the row is
+// sent, see columnMapping.apply, so a row put back after a failed flush
+// keeps the shape it was logged with.
+func rowShape(row bufferedRow) string {
+	keys := make([]string, 0, len(row.fields))
+	for key := range row.fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, "\x00")
+}
+
+// groupRows reorders rows so that rows with the same key are adjacent, with
+// groups in order of their first row and rows in their original order within
+// each group. It returns the reordered rows and the end offset of each group.
+func groupRows(rows []bufferedRow, key func(bufferedRow) string) ([]bufferedRow, []int) {
+	var order []string
+	groups := make(map[string][]bufferedRow)
+	for _, row := range rows {
+		k := key(row)
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], row)
+	}
+
+	grouped := make([]bufferedRow, 0, len(rows))
+	ends := make([]int, 0, len(order))
+	for _, k := range order {
+		grouped = append(grouped, groups[k]...)
+		ends = append(ends, len(grouped))
+	}
+	return grouped, ends
+}
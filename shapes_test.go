@@ -0,0 +1,59 @@
+package chwriter
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRowShape(t *testing.T) {
+	a := bufferedRow{fields: map[string]any{"status": 200.0, "uri": "/"}}
+	b := bufferedRow{fields: map[string]any{"uri": "/a", "status": 404.0}}
+	c := bufferedRow{fields: map[string]any{"uri": "/"}}
+	if rowShape(a) != rowShape(b) {
+		t.Errorf("rows with the same keys have different shapes")
+	}
+	if rowShape(a) == rowShape(c) {
+		t.Errorf("rows with different keys have the same shape")
+	}
+}
+
+// Rows put back after a failed flush must not pick up the derived columns
+// they were sent with, or every later flush reports a shape mismatch
+// between them and newly written rows.
+func TestRowShapesStableAcrossRetries(t *testing.T) {
+	fake := newFakeConn("uri String", "size UInt64", "received_at DateTime64(3)")
+	conn := newTestConn(fake)
+	conn.rowShapes = rowShapesWarn
+	conn.columns = columnMapping{
+		responseSize: sizeColumn{column: "size", fields: testPaths(defaultResponseSizeFields)},
+		receivedAt:   "received_at",
+	}
+
+	if _, err := conn.Write([]byte(`{"uri":"/a","size":10}`)); err != nil {
+		t.Fatal(err)
+	}
+	fake.failSends(errors.New("server unavailable"))
+	if err := conn.flush(context.Background()); err == nil {
+		t.Fatal("flush succeeded, want the injected error")
+	}
+	if _, err := conn.Write([]byte(`{"uri":"/b","size":20}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conn.stats.rowShapeMismatches; n != 0 {
+		t.Errorf("rowShapeMismatches = %d, want 0", n)
+	}
+	rows := fake.rows()
+	if len(rows) != 2 {
+		t.Fatalf("sent %d rows, want 2", len(rows))
+	}
+	for i, want := range []uint64{10, 20} {
+		if rows[i][1] != want {
+			t.Errorf("row %d: size = %v, want %d", i, rows[i][1], want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package chwriter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultStatsInterval is how often a stats row is inserted when stats_table
+// is set without an explicit stats_interval.
+const defaultStatsInterval = time.Minute
+
+// flushStats accumulates the operational counters of a clickhouseConn. It is
+// guarded by the connection's bufferMu. Counters are cumulative for the
+// lifetime of the connection.
+type flushStats struct {
+	rowsFlushed       uint64
+	flushErrors       uint64
+	lastFlushDuration time.Duration
+
+	// insertDiscrepancies counts flushes where verify_inserts found fewer
+	// new rows in the table than were sent.
+	insertDiscrepancies uint64
+
+	// staleRowsDropped counts rows discarded for exceeding max_row_staleness.
+	staleRowsDropped uint64
+
+	// columnErrors counts failed flushes by the column the error was
+	// attributed to. Failures that name no column are only counted in
+	// flushErrors.
+	columnErrors map[string]uint64
+
+	// rowShapeMismatches counts flushes whose rows did not all have the same
+	// keys, when validate_row_shapes is enabled.
+	rowShapeMismatches uint64
+
+	// rowsOverThreshold counts rows buffered while the buffer held at least
+	// buffer_warn_threshold rows.
+	rowsOverThreshold uint64
+
+	// rowsFiltered counts log lines dropped by drop_uri_patterns.
+	rowsFiltered uint64
+
+	// rowsSampledOut counts log lines dropped by sample_rate.
+	rowsSampledOut uint64
+
+	// warmupDropped counts log lines dropped by startup_discard_duration.
+	warmupDropped uint64
+
+	// rowsRejected counts rows left out of inserts by on_extra_field error
+	// for having a field without a column, and by missing_columns strict
+	// for lacking a field for a column that is neither Nullable nor has a
+	// DEFAULT.
+	rowsRejected uint64
+
+	// partialWrites counts batches that only one of the dual_write servers
+	// accepted.
+	partialWrites uint64
+}
+
+// statsRow is a single row inserted into the stats table. The table is
+// expected to have the following columns:
+//
+//	CREATE TABLE <stats_table> (
+//	    ts DateTime64(3),
+//	    writer String,
+//	    rows_flushed UInt64,
+//	    flush_errors UInt64,
+//	    buffer_depth UInt64,
+//	    last_flush_duration_ms Float64,
+//	    insert_discrepancies UInt64,
+//	    stale_rows_dropped UInt64,
+//	    column_errors Map(String, UInt64),
+//	    row_shape_mismatches UInt64,
+//	    rows_over_threshold UInt64,
+//	    rows_filtered UInt64,
+//	    rows_sampled_out UInt64,
+//	    circuit_state LowCardinality(String),
+//	    circuit_opens UInt64,
+//	    circuit_rejected UInt64,
+//	    rows_rejected UInt64 COMMENT 'left out by on_extra_field error or missing_columns strict',
+//	    unsent_rows UInt64,
+//	    oldest_unsent_age_ms Float64,
+//	    at_risk Bool,
+//	    partial_writes UInt64,
+//	    warmup_dropped UInt64
+//	) ENGINE = MergeTree ORDER BY (writer, ts)
+type statsRow struct {
+	Ts                  time.Time         `ch:"ts"`
+	Writer              string            `ch:"writer"`
+	RowsFlushed         uint64            `ch:"rows_flushed"`
+	FlushErrors         uint64            `ch:"flush_errors"`
+	BufferDepth         uint64            `ch:"buffer_depth"`
+	LastFlushDurationMs float64           `ch:"last_flush_duration_ms"`
+	InsertDiscrepancies uint64            `ch:"insert_discrepancies"`
+	StaleRowsDropped    uint64            `ch:"stale_rows_dropped"`
+	ColumnErrors        map[string]uint64 `ch:"column_errors"`
+	RowShapeMismatches  uint64            `ch:"row_shape_mismatches"`
+	RowsOverThreshold   uint64            `ch:"rows_over_threshold"`
+	RowsFiltered        uint64            `ch:"rows_filtered"`
+	RowsSampledOut      uint64            `ch:"rows_sampled_out"`
+	CircuitState        string            `ch:"circuit_state"`
+	CircuitOpens        uint64            `ch:"circuit_opens"`
+	CircuitRejected     uint64            `ch:"circuit_rejected"`
+	RowsRejected        uint64            `ch:"rows_rejected"`
+	UnsentRows          uint64            `ch:"unsent_rows"`
+	OldestUnsentAgeMs   float64           `ch:"oldest_unsent_age_ms"`
+	AtRisk              bool              `ch:"at_risk"`
+	PartialWrites       uint64            `ch:"partial_writes"`
+	WarmupDropped       uint64            `ch:"warmup_dropped"`
+}
+
+// snapshotStats returns the current stats of the connection as a statsRow.
+func (conn *clickhouseConn) snapshotStats() statsRow {
+	conn.bufferMu.Lock()
+	defer conn.bufferMu.Unlock()
+
+	now := time.Now()
+	unsent, oldestAge := conn.unsentRows(now)
+	atRisk := conn.atRiskRows > 0 && unsent >= conn.atRiskRows ||
+		conn.atRiskAge > 0 && oldestAge >= conn.atRiskAge
+
+	return statsRow{
+		Ts:                  now,
+		Writer:              conn.key,
+		RowsFlushed:         conn.stats.rowsFlushed,
+		FlushErrors:         conn.stats.flushErrors,
+		BufferDepth:         uint64(len(conn.buffer)),
+		LastFlushDurationMs: float64(conn.stats.lastFlushDuration) / float64(time.Millisecond),
+		InsertDiscrepancies: conn.stats.insertDiscrepancies,
+		StaleRowsDropped:    conn.stats.staleRowsDropped,
+		ColumnErrors:        maps.Clone(conn.stats.columnErrors),
+		RowShapeMismatches:  conn.stats.rowShapeMismatches,
+		RowsOverThreshold:   conn.stats.rowsOverThreshold,
+		RowsFiltered:        conn.stats.rowsFiltered,
+		RowsSampledOut:      conn.stats.rowsSampledOut,
+		CircuitState:        conn.circuit.state.String(),
+		CircuitOpens:        conn.circuit.opens,
+		CircuitRejected:     conn.circuit.rejected,
+		RowsRejected:        conn.stats.rowsRejected,
+		UnsentRows:          uint64(unsent),
+		OldestUnsentAgeMs:   float64(oldestAge) / float64(time.Millisecond),
+		AtRisk:              atRisk,
+		PartialWrites:       conn.stats.partialWrites,
+		WarmupDropped:       conn.stats.warmupDropped,
+	}
+}
+
+// unsentRows returns how many rows have been written but not sent yet,
+// counting both the buffer and a flush in progress, and how long ago the
+// oldest of them was received. It must be called with bufferMu held.
+func (conn *clickhouseConn) unsentRows(now time.Time) (int, time.Duration) {
+	var oldest time.Time
+	if conn.inFlight > 0 {
+		oldest = conn.inFlightSince
+	}
+	if len(conn.buffer) > 0 && (oldest.IsZero() || conn.buffer[0].receivedAt.Before(oldest)) {
+		oldest = conn.buffer[0].receivedAt
+	}
+
+	var age time.Duration
+	if !oldest.IsZero() {
+		age = now.Sub(oldest)
+	}
+	return len(conn.buffer) + conn.inFlight, age
+}
+
+// writeStats inserts a snapshot of the connection stats into the stats table.
+// The buffer lock is only held while taking the snapshot so that stats
+// reporting never blocks Write on a slow insert.
+func (conn *clickhouseConn) writeStats() error {
+	row := conn.snapshotStats()
+	if row.AtRisk {
+		conn.logger.Warn("unsent rows at risk of being lost",
+			zap.String("writer", conn.key),
+			zap.Uint64("rows", row.UnsentRows),
+			zap.Float64("oldest_age_ms", row.OldestUnsentAgeMs),
+		)
+	}
+
+	conn.connMu.RLock()
+	defer conn.connMu.RUnlock()
+	batch, err := conn.Conn.PrepareBatch(conn.queryContext(context.Background()), insertQuery(conn.statsTable, conn.queryComment))
+	if err != nil {
+		return fmt.Errorf("failed to prepare stats batch: %w", wrapAuthError(err, conn.username))
+	}
+	defer batch.Close()
+
+	if err := batch.AppendStruct(&row); err != nil {
+		return fmt.Errorf("failed to append stats row: %w", err)
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("failed to send stats batch: %w", err)
+	}
+	return nil
+}
+
+func (conn *clickhouseConn) statsLoop() {
+	defer conn.wg.Done()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-time.After(conn.statsInterval):
+			if err := conn.writeStats(); err != nil {
+				conn.logger.Error("failed to write stats", zap.String("writer", conn.key), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package chwriter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// tableFunctionPattern matches a table function call such as remote(...).
+var tableFunctionPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\s*\(`)
+
+// isTableFunction reports whether table is a table function call rather than
+// a (possibly database qualified) table name. The table option accepts calls
+// like remote('host:9000', db, logs) or s3(...) and inserts into them with
+// INSERT INTO FUNCTION, provided the function supports inserts.
+func isTableFunction(table string) bool {
+	return tableFunctionPattern.MatchString(strings.TrimSpace(table))
+}
+
+// validateTable checks that table is either a plain table name or a single
+// table function call the driver can parse. The driver extracts the insert
+// target with a regular expression that allows at most one level of nested
+// parentheses inside the call, for instance
+// s3('https://bucket/logs.json', 'JSONEachRow', 'ts DateTime64(3), msg String').
+func validateTable(table string) error {
+	table = strings.TrimSpace(table)
+	if !isTableFunction(table) {
+		if strings.ContainsAny(table, "()") {
+			return fmt.Errorf("invalid table %q: parentheses are only allowed in table function calls", table)
+		}
+		return nil
+	}
+
+	depth, maxDepth := 0, 0
+	for i, r := range table {
+		switch r {
+		case '(':
+			depth++
+			maxDepth = max(maxDepth, depth)
+		case ')':
+			depth--
+			if depth == 0 && i != len(table)-1 {
+				return fmt.Errorf("invalid table function %q: unexpected text after the closing parenthesis", table)
+			}
+		}
+		if depth < 0 {
+			return fmt.Errorf("invalid table function %q: unbalanced parentheses", table)
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("invalid table function %q: unbalanced parentheses", table)
+	}
+	if maxDepth > 2 {
+		return fmt.Errorf("invalid table function %q: arguments may nest parentheses at most one level deep", table)
+	}
+	return nil
+}
+
+// splitTable splits a table name into its database, which is empty if the
+// name is not qualified, and the table itself, without identifier quotes.
+func splitTable(table string) (database, name string) {
+	unquote := func(s string) string {
+		return strings.Trim(strings.TrimSpace(s), "`\"")
+	}
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return unquote(table[:i]), unquote(table[i+1:])
+	}
+	return "", unquote(table)
+}
+
+// defaultDatabase is the database the driver connects to when db_name is not
+// set.
+const defaultDatabase = "default"
+
+// foreignDatabase returns the database table is qualified with if it differs
+// from dbName, the database the connection uses, or an empty string if table
+// lives in that database. Table functions are never reported.
+func foreignDatabase(table, dbName string) string {
+	if isTableFunction(table) {
+		return ""
+	}
+	if dbName == "" {
+		dbName = defaultDatabase
+	}
+	database, _ := splitTable(table)
+	if database == "" || database == dbName {
+		return ""
+	}
+	return database
+}
+
+// insertQuery returns the INSERT statement for table, which is passed through
+// verbatim so that qualified names and table function arguments are kept
+// intact. A non-empty comment is embedded right after INSERT INTO, the only
+// place the driver keeps it, and must have been escaped with
+// escapeQueryComment.
+func insertQuery(table, comment string) string {
+	prefix := "INSERT INTO"
+	if comment != "" {
+		prefix = fmt.Sprintf("INSERT INTO /* %s */", comment)
+	}
+	if isTableFunction(table) {
+		return fmt.Sprintf("%s FUNCTION %s", prefix, strings.TrimSpace(table))
+	}
+	return fmt.Sprintf("%s %s", prefix, table)
+}
+
+// queryCommentEscaper neutralizes everything in a query comment that could
+// end the comment early or confuse the driver, which locates the insert
+// target with a regular expression that stops at the first parenthesis and
+// cuts the query at an upper case VALUES keyword.
+var queryCommentEscaper = strings.NewReplacer(
+	"*/", "* /",
+	"/*", "/ *",
+	"(", "[",
+	")", "]",
+	"VALUES", "values",
+)
+
+// queryCommentFormat matches the FORMAT keyword in any case. The driver
+// strips a FORMAT clause, FORMAT and the word after it, from anywhere in an
+// INSERT, which would take the end of the comment with it when the comment
+// ends in "format".
+var queryCommentFormat = regexp.MustCompile(`(?i)\bformat\b`)
+
+// escapeQueryComment makes comment safe to embed in a /* */ SQL comment. It
+// is also collapsed onto a single line.
+func escapeQueryComment(comment string) string {
+	comment = queryCommentEscaper.Replace(strings.Join(strings.Fields(comment), " "))
+	return queryCommentFormat.ReplaceAllString(comment, "[$0]")
+}
@@ -0,0 +1,68 @@
+package chwriter
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// driverFormatClause is the expression clickhouse-go strips FORMAT clauses
+// from an INSERT with before it sends it.
+var driverFormatClause = regexp.MustCompile(`(?i)\sFORMAT\s+[^\s]+`)
+
+func TestEscapeQueryComment(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    string
+	}{
+		{"caddy logs", "caddy logs"},
+		{"ends */ early", "ends * / early"},
+		{"opens /* another", "opens / * another"},
+		{"f(x)", "f[x]"},
+		{"VALUES here", "values here"},
+		{"multi\nline\tcomment", "multi line comment"},
+		{"log format", "log [format]"},
+		{"FORMAT JSONEachRow", "[FORMAT] JSONEachRow"},
+		{"Format", "[Format]"},
+		{"reformatted formats", "reformatted formats"},
+	}
+	for _, tt := range tests {
+		if got := escapeQueryComment(tt.comment); got != tt.want {
+			t.Errorf("escapeQueryComment(%q) = %q, want %q", tt.comment, got, tt.want)
+		}
+	}
+}
+
+// The whole comment, up to its closing */, must survive the driver's
+// rewriting of the query.
+func TestInsertQueryCommentSurvivesDriver(t *testing.T) {
+	for _, comment := range []string{"log format", "Format", "a FORMAT b", "format\t*/"} {
+		query := insertQuery("logs", escapeQueryComment(comment))
+		if got := driverFormatClause.ReplaceAllString(query, ""); got != query {
+			t.Errorf("comment %q: driver rewrites %q to %q", comment, query, got)
+		}
+		if !strings.HasSuffix(query, " */ logs") {
+			t.Errorf("comment %q: query %q does not end the comment before the table", comment, query)
+		}
+	}
+}
+
+func TestForeignDatabase(t *testing.T) {
+	tests := []struct {
+		table, dbName, want string
+	}{
+		{"logs", "", ""},
+		{"logs", "analytics", ""},
+		{"default.logs", "", ""},
+		{"analytics.logs", "analytics", ""},
+		{"`analytics`.`logs`", "analytics", ""},
+		{"analytics.logs", "", "analytics"},
+		{`"other".logs`, "analytics", "other"},
+		{"remote('host:9000', other.logs)", "analytics", ""},
+	}
+	for _, tt := range tests {
+		if got := foreignDatabase(tt.table, tt.dbName); got != tt.want {
+			t.Errorf("foreignDatabase(%q, %q) = %q, want %q", tt.table, tt.dbName, got, tt.want)
+		}
+	}
+}
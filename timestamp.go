@@ -0,0 +1,97 @@
+package chwriter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp interprets a decoded timestamp field. Depending on Caddy's
+// time_format it is either a number of seconds, milliseconds, microseconds
+// or nanoseconds since the epoch, or a formatted string. Numbers are told apart by their
+// magnitude, and strings are parsed as RFC 3339, then with layout if it is
+// set, then as a number. Values that are already a time.Time are returned
+// as is.
+func parseTimestamp(value any, layout string) (time.Time, bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value, true
+	case float64:
+		return parseEpoch(value)
+	case string:
+		value = strings.TrimSpace(value)
+		if ts, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return ts, true
+		}
+		if layout != "" {
+			if ts, err := time.Parse(layout, value); err == nil {
+				return ts, true
+			}
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return parseEpoch(number)
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseEpoch converts a number of seconds, milliseconds, microseconds or
+// nanoseconds since the epoch to a time, picking the unit by magnitude.
+// Seconds are assumed for anything up to the year 5138.
+func parseEpoch(number float64) (time.Time, bool) {
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return time.Time{}, false
+	}
+
+	var unit time.Duration
+	switch abs := math.Abs(number); {
+	case abs < 1e11:
+		unit = time.Second
+	case abs < 1e14:
+		unit = time.Millisecond
+	case abs < 1e17:
+		unit = time.Microsecond
+	default:
+		unit = time.Nanosecond
+	}
+
+	whole, frac := math.Modf(number / float64(time.Second/unit))
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), true
+}
+
+// coerceTimestamp replaces the timestamp field of row with its parsed time so
+// that it can be inserted into a DateTime or DateTime64 column. Values that
+// cannot be parsed are left untouched.
+func (mapping *columnMapping) coerceTimestamp(row map[string]any) {
+	value, ok := row[mapping.timestampField]
+	if !ok {
+		return
+	}
+	if ts, ok := parseTimestamp(value, mapping.timestampLayout); ok {
+		row[mapping.timestampField] = ts
+	}
+}
+
+// calendarDate returns the date of ts in location as midnight UTC, which the
+// driver stores as that date in a Date column whatever its time zone.
+func calendarDate(ts time.Time, location *time.Location) time.Time {
+	year, month, day := ts.In(location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// dropStale removes the rows whose timestamp field is older than
+// maxRowStaleness and returns the remaining rows along with the number of
+// rows dropped. Rows without a parseable timestamp are kept.
+func (conn *clickhouseConn) dropStale(rows []bufferedRow) ([]bufferedRow, int) {
+	cutoff := time.Now().Add(-conn.maxRowStaleness)
+	kept := rows[:0]
+	for _, row := range rows {
+		value := conn.columns.timestampPath.lookup(row.fields)
+		if ts, ok := parseTimestamp(value, conn.columns.timestampLayout); ok && ts.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, row)
+	}
+	return kept, len(rows) - len(kept)
+}
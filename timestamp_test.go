@@ -0,0 +1,132 @@
+package chwriter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name   string
+		value  any
+		layout string
+		ok     bool
+	}{
+		{"seconds", 1714564800.5, "", true},
+		{"milliseconds", 1714564800500.0, "", true},
+		{"microseconds", 1714564800500000.0, "", true},
+		{"nanoseconds", 1714564800500000000.0, "", true},
+		{"rfc3339", "2024-05-01T12:00:00.5Z", "", true},
+		{"rfc3339 with offset", "2024-05-01T14:00:00.5+02:00", "", true},
+		{"layout", "01/May/2024:12:00:00.5 +0000", "02/Jan/2006:15:04:05 -0700", true},
+		{"numeric string", " 1714564800.5 ", "", true},
+		{"time", want, "", true},
+		{"unparseable", "yesterday", "", false},
+		{"nan", math.NaN(), "", false},
+		{"missing", nil, "", false},
+		{"bool", true, "", false},
+	}
+	for _, tt := range tests {
+		ts, ok := parseTimestamp(tt.value, tt.layout)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && !ts.Equal(want) {
+			t.Errorf("%s: %v, want %v", tt.name, ts, want)
+		}
+	}
+}
+
+func TestCoerceTimestamp(t *testing.T) {
+	mapping := &columnMapping{timestampField: "ts"}
+
+	row := map[string]any{"ts": 1714564800.0}
+	mapping.coerceTimestamp(row)
+	if ts, ok := row["ts"].(time.Time); !ok || ts.Unix() != 1714564800 {
+		t.Errorf("present: ts = %v, want the parsed time", row["ts"])
+	}
+
+	row = map[string]any{"ts": "not a time"}
+	mapping.coerceTimestamp(row)
+	if row["ts"] != "not a time" {
+		t.Errorf("unparseable: ts = %v, want it left untouched", row["ts"])
+	}
+
+	row = map[string]any{}
+	mapping.coerceTimestamp(row)
+	if _, ok := row["ts"]; ok {
+		t.Errorf("absent: ts = %v, want it left absent", row["ts"])
+	}
+}
+
+func TestCalendarDateTimezoneBoundaries(t *testing.T) {
+	load := func(name string) *time.Location {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skipf("time zone database unavailable: %v", err)
+		}
+		return location
+	}
+	newYork, tokyo := load("America/New_York"), load("Asia/Tokyo")
+	utc := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		ts       time.Time
+		location *time.Location
+		want     string
+	}{
+		{utc("2024-05-01T23:59:59Z"), time.UTC, "2024-05-01"},
+		{utc("2024-05-02T00:00:00Z"), time.UTC, "2024-05-02"},
+		{utc("2024-05-01T23:30:00Z"), tokyo, "2024-05-02"},
+		{utc("2024-05-01T14:59:59Z"), tokyo, "2024-05-01"},
+		{utc("2024-05-01T15:00:00Z"), tokyo, "2024-05-02"},
+		{utc("2024-05-02T03:59:59Z"), newYork, "2024-05-01"},
+		{utc("2024-05-02T04:00:00Z"), newYork, "2024-05-02"},
+		// Midnight in New York is 05:00 UTC in winter and 04:00 UTC in
+		// summer.
+		{utc("2024-01-15T04:30:00Z"), newYork, "2024-01-14"},
+		{utc("2024-03-10T04:59:59Z"), newYork, "2024-03-09"},
+		{utc("2024-03-10T05:00:00Z"), newYork, "2024-03-10"},
+		{utc("2024-11-03T03:59:59Z"), newYork, "2024-11-02"},
+		{utc("2024-11-03T04:00:00Z"), newYork, "2024-11-03"},
+	}
+	for _, tt := range tests {
+		date := calendarDate(tt.ts, tt.location)
+		if got := date.Format(time.DateOnly); got != tt.want {
+			t.Errorf("%v in %v: %s, want %s", tt.ts, tt.location, got, tt.want)
+		}
+		if date.Location() != time.UTC || date.Hour() != 0 {
+			t.Errorf("%v in %v: %v, want midnight UTC", tt.ts, tt.location, date)
+		}
+	}
+}
+
+// Without a parseable timestamp the date is taken from when the line was
+// received.
+func TestDateColumnFallsBackToReceivedAt(t *testing.T) {
+	mapping := &columnMapping{
+		timestampField: "ts",
+		timestampPath:  mustParsePath("ts"),
+		date:           "date",
+		location:       time.UTC,
+	}
+	received := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+	for _, fields := range []map[string]any{{}, {"ts": "garbage"}} {
+		row := mapping.apply(bufferedRow{fields: fields, receivedAt: received})
+		if got := row["date"].(time.Time).Format(time.DateOnly); got != "2024-05-03" {
+			t.Errorf("%v: date = %s, want 2024-05-03", fields, got)
+		}
+	}
+	row := mapping.apply(bufferedRow{fields: map[string]any{"ts": 1714564800.0}, receivedAt: received})
+	if got := row["date"].(time.Time).Format(time.DateOnly); got != "2024-05-01" {
+		t.Errorf("timestamp: date = %s, want 2024-05-01", got)
+	}
+}
@@ -0,0 +1,52 @@
+package chwriter
+
+import (
+	"context"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// flushSpanName is the name of the span traced around every flush.
+const flushSpanName = "clickhouse.flush"
+
+// traceFlush starts a span for a flush of rows rows when tracing is enabled
+// and returns the context to send the rows with, along with a function that
+// ends the span with the outcome of sendChunks. The span is a child of the
+// span in ctx, if any, such as the caller's of FlushAndWait, and its
+// context is passed to the server so that the inserts show up in the
+// server's own traces. Spans are created with the global tracer provider,
+// which the process has to register; without one they cost next to
+// nothing.
+func (conn *clickhouseConn) traceFlush(ctx context.Context, rows int) (context.Context, func(sent, rejected int, err error)) {
+	if !conn.tracing {
+		return ctx, func(int, int, error) {}
+	}
+
+	ctx, span := otel.Tracer(modulePath).Start(ctx, flushSpanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "clickhouse"),
+			attribute.String("clickhouse.writer", conn.key),
+			attribute.String("clickhouse.table", conn.table),
+			attribute.Int("clickhouse.rows", rows),
+		),
+	)
+	ctx = clickhouse.Context(ctx, clickhouse.WithSpan(span.SpanContext()))
+
+	return ctx, func(sent, rejected int, err error) {
+		span.SetAttributes(
+			attribute.Int("clickhouse.rows_inserted", sent-rejected),
+			attribute.Int("clickhouse.rows_rejected", rejected),
+			attribute.Bool("clickhouse.success", err == nil),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
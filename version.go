@@ -0,0 +1,68 @@
+package chwriter
+
+import (
+	"runtime/debug"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// modulePath is the Go module path of this writer, looked up in the build
+// info of the binary to find the version it was built with.
+const modulePath = "github.com/timmy-feng/clickhouse-writer"
+
+// unknownVersion is stored when the build info of the binary does not say
+// which version of a module it contains.
+const unknownVersion = "unknown"
+
+// readCaddyVersion returns the version of Caddy the binary was built with,
+// such as "v2.9.1", as Caddy itself reports it.
+func readCaddyVersion() string {
+	simple, _ := caddy.Version()
+	if simple == "" {
+		return unknownVersion
+	}
+	return simple
+}
+
+// readModuleVersion returns the version of this module the binary was
+// built with. Binaries built by xcaddy list it as a dependency, possibly
+// replaced by a local checkout, which has no version; when the module is
+// the main module, as in its own tests, Go reports "(devel)" unless built
+// from a tagged release.
+func readModuleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknownVersion
+	}
+	module := &info.Main
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			module = dep
+			break
+		}
+	}
+	if module.Path != modulePath {
+		return unknownVersion
+	}
+	if module.Replace != nil {
+		module = module.Replace
+	}
+	if module.Version == "" {
+		return unknownVersion
+	}
+	return module.Version
+}
+
+// versionColumns resolves the versions that version_columns stores, keyed
+// by column. They cannot change while the process runs, so they are looked
+// up once when the writer is provisioned.
+func (writer *ClickHouseWriter) versionColumns() map[string]string {
+	columns := map[string]string{}
+	if writer.CaddyVersionColumn != "" {
+		columns[writer.CaddyVersionColumn] = readCaddyVersion()
+	}
+	if writer.ModuleVersionColumn != "" {
+		columns[writer.ModuleVersionColumn] = readModuleVersion()
+	}
+	return columns
+}
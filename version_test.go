@@ -0,0 +1,26 @@
+package chwriter
+
+import "testing"
+
+func TestVersionColumns(t *testing.T) {
+	if columns := (&ClickHouseWriter{}).versionColumns(); len(columns) != 0 {
+		t.Errorf("without version columns: %v, want none", columns)
+	}
+
+	writer := &ClickHouseWriter{CaddyVersionColumn: "caddy_version", ModuleVersionColumn: "module_version"}
+	columns := writer.versionColumns()
+	if len(columns) != 2 {
+		t.Fatalf("versionColumns = %v, want both columns", columns)
+	}
+	for column, version := range columns {
+		if version == "" {
+			t.Errorf("%s is empty, want a version or %q", column, unknownVersion)
+		}
+	}
+
+	mapping := columnMapping{constants: columns}
+	row := applyTest(mapping, map[string]any{"caddy_version": "logged"})
+	if row["caddy_version"] != columns["caddy_version"] || row["module_version"] != columns["module_version"] {
+		t.Errorf("row = %v, want the versions %v", row, columns)
+	}
+}